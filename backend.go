@@ -0,0 +1,826 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"go.uber.org/zap"
+)
+
+// Backend provides a consistent interface for implementing the storage backend
+type Backend interface {
+	// PutBlobs stores data blocks and returns a reference for each block
+	PutBlobs(blobs [][]byte) ([]BlobRef, error)
+	// GetBlob reads the data block at ref into buffer
+	GetBlob(ref BlobRef, buffer []byte) (int, error)
+	// AppendTxs appends tx batches to the log and returns an ID for each batch
+	AppendTxs(batches [][]byte) ([]string, error)
+	// ListTxs lists tx batches starting from the pinned checkpoint
+	ListTxs() ([]TxRecord, error)
+	// PinCheckpoint marks the tx batch with id as the start of the log
+	PinCheckpoint(id string) error
+}
+
+// BlobLocator is implemented by backends that store blocks in messages
+type BlobLocator interface {
+	// LocateBlobs maps the ID of every stored block to the ID of its message
+	LocateBlobs() (map[string]string, error)
+}
+
+// TxTailer is implemented by backends that can list the end of the tx log
+type TxTailer interface {
+	// PinnedCheckpoint returns the ID of the pinned checkpoint, or an empty
+	// ID if no checkpoint is pinned
+	PinnedCheckpoint() (string, error)
+	// ListTxsAfter lists tx batches appended after the batch with id
+	ListTxsAfter(id string) ([]TxRecord, error)
+	// ListTxIDsAfter lists the IDs of the tx batches appended after the
+	// batch with id without reading them
+	ListTxIDsAfter(id string) ([]string, error)
+}
+
+// TxSubscriber is implemented by backends that receive the tx batches of
+// other clients
+type TxSubscriber interface {
+	// SubscribeTxs applies the tx batches of other clients to fs, or stops
+	// applying them if fs is nil
+	SubscribeTxs(fs *Dsfs)
+}
+
+// BlobMessage is a message holding stored blocks
+type BlobMessage struct {
+	ID    string
+	Time  time.Time
+	Blobs []string
+	Size  int64
+}
+
+// BlobCollector is implemented by backends that can delete stored blocks
+type BlobCollector interface {
+	// ListBlobMessages lists every message holding stored blocks
+	ListBlobMessages() ([]BlobMessage, error)
+	// DeleteBlobMessage deletes a message and the blocks it holds
+	DeleteBlobMessage(id string) error
+}
+
+// BlobRef locates a data block stored in a Backend
+// MessageID is only set by backends that store blocks in messages.
+type BlobRef struct {
+	ID        string
+	MessageID string
+}
+
+// TxRecord is a tx batch stored in a Backend
+// Time is when the batch was appended, if the backend records it.
+type TxRecord struct {
+	ID   string
+	Time time.Time
+	Data []byte
+}
+
+// DiscordBackend implements Backend backed by attachments in Discord channels
+type DiscordBackend struct {
+	dg          *discordgo.Session
+	txChannel   *discordgo.Channel
+	dataChannel *discordgo.Channel
+	// pinLock serializes reading and moving the pinned start point
+	pinLock   sync.Mutex
+	pinnedMsg *discordgo.Message
+	cdn       *CDNClient
+	urls      *URLCache
+	// live is the mounted volume receiving remote txs
+	live atomic.Pointer[Dsfs]
+}
+
+// NewDiscordBackend creates a new DiscordBackend and prepares its channels
+// An empty gateway uses the gateway advertised by the API.
+func NewDiscordBackend(token string, userToken bool, guildID string, gateway string) (*DiscordBackend, error) {
+	var tokenPrefix string
+	if !userToken {
+		tokenPrefix = "Bot "
+	}
+
+	dg, err := discordgo.New(tokenPrefix + token)
+	if err != nil {
+		return nil, fmt.Errorf("error creating Discord session, %w", err)
+	}
+
+	dg.Identify.Intents = discordgo.IntentsGuildMessages
+	setGateway(dg, gateway)
+
+	err = dg.Open()
+	if err != nil {
+		return nil, fmt.Errorf("error opening connection, %w", err)
+	}
+
+	txChannel, dataChannel, err := prepareChannels(dg, guildID)
+	if err != nil {
+		return nil, err
+	}
+
+	backend := &DiscordBackend{
+		dg:          dg,
+		txChannel:   txChannel,
+		dataChannel: dataChannel,
+		cdn:         NewCDNClient(),
+		urls:        NewURLCache(),
+	}
+	dg.AddHandler(backend.messageCreate)
+	return backend, nil
+}
+
+// PutBlobs sends data blocks as attachments of a single message
+func (b *DiscordBackend) PutBlobs(blobs [][]byte) ([]BlobRef, error) {
+	msg, err := b.sendFiles(b.dataChannel.ID, DataChannelName, blobs)
+	if err != nil {
+		return nil, err
+	}
+	b.cacheURLs(msg)
+	refs := make([]BlobRef, len(msg.Attachments))
+	for i, attachment := range msg.Attachments {
+		refs[i] = BlobRef{ID: attachment.ID, MessageID: msg.ID}
+	}
+	return refs, nil
+}
+
+// GetBlob downloads an attachment and writes to buffer
+// Attachment URLs are signed and expire. Rejected URLs are signed again
+// through the message of the block, or the refresh endpoint for blocks
+// stored before message IDs were recorded.
+func (b *DiscordBackend) GetBlob(ref BlobRef, buffer []byte) (int, error) {
+	url, ok := b.urls.Get(ref.ID)
+	refreshed := false
+	if !ok && ref.MessageID != "" {
+		var err error
+		if url, err = b.refreshURL(ref); err != nil {
+			return 0, err
+		}
+		refreshed = true
+	} else if !ok {
+		url = attachmentURL(b.dataChannel.ID, ref.ID, DataChannelName)
+	}
+
+	body, err := b.cdn.Get(url, buffer[:0])
+	var statusErr *StatusError
+	if !refreshed && errors.As(err, &statusErr) &&
+		(statusErr.StatusCode == http.StatusForbidden || statusErr.StatusCode == http.StatusNotFound) {
+		zap.S().Debugw("attachment URL was rejected, refreshing", "id", ref.ID, "error", err)
+		b.urls.Delete(ref.ID)
+		var refreshErr error
+		if url, refreshErr = b.refreshURL(ref); refreshErr != nil {
+			return 0, fmt.Errorf("%w, %v", err, refreshErr)
+		}
+		body, err = b.cdn.Get(url, buffer[:0])
+	}
+	if err != nil {
+		return 0, err
+	}
+	return copy(buffer, body), nil
+}
+
+// refreshURL signs the URL of a block again and caches it
+func (b *DiscordBackend) refreshURL(ref BlobRef) (string, error) {
+	if ref.MessageID != "" {
+		msg, err := b.dg.ChannelMessage(b.dataChannel.ID, ref.MessageID)
+		if err != nil {
+			return "", fmt.Errorf("failed to get message %s, %w", ref.MessageID, err)
+		}
+		// Blocks of a message are usually read together
+		b.cacheURLs(msg)
+		for _, attachment := range msg.Attachments {
+			if attachment.ID == ref.ID {
+				return signedAttachmentURL(b.dataChannel.ID, attachment.ID, DataChannelName, attachment.URL), nil
+			}
+		}
+		return "", fmt.Errorf("attachment %s is not in message %s", ref.ID, ref.MessageID)
+	}
+
+	endpoint := discordgo.EndpointAPI + "attachments/refresh-urls"
+	request := struct {
+		AttachmentURLs []string `json:"attachment_urls"`
+	}{[]string{attachmentURL(b.dataChannel.ID, ref.ID, DataChannelName)}}
+	body, err := b.dg.RequestWithBucketID(http.MethodPost, endpoint, request, endpoint)
+	if err != nil {
+		return "", fmt.Errorf("failed to refresh attachment %s, %w", ref.ID, err)
+	}
+	var response struct {
+		RefreshedURLs []struct {
+			Original  string `json:"original"`
+			Refreshed string `json:"refreshed"`
+		} `json:"refreshed_urls"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return "", err
+	}
+	if len(response.RefreshedURLs) != 1 {
+		return "", fmt.Errorf("attachment %s was not refreshed", ref.ID)
+	}
+	url := signedAttachmentURL(b.dataChannel.ID, ref.ID, DataChannelName, response.RefreshedURLs[0].Refreshed)
+	b.urls.Put(ref.ID, url)
+	return url, nil
+}
+
+// cacheURLs caches the signed URLs of the attachments of a data message
+func (b *DiscordBackend) cacheURLs(msg *discordgo.Message) {
+	for _, attachment := range msg.Attachments {
+		b.urls.Put(attachment.ID, signedAttachmentURL(b.dataChannel.ID, attachment.ID, DataChannelName, attachment.URL))
+	}
+}
+
+// LocateBlobs maps the ID of every stored block to the ID of its message
+func (b *DiscordBackend) LocateBlobs() (map[string]string, error) {
+	messages, err := b.ListBlobMessages()
+	if err != nil {
+		return nil, err
+	}
+	located := make(map[string]string)
+	for _, msg := range messages {
+		for _, id := range msg.Blobs {
+			located[id] = msg.ID
+		}
+	}
+	return located, nil
+}
+
+// ListBlobMessages lists every message of the data channel
+func (b *DiscordBackend) ListBlobMessages() ([]BlobMessage, error) {
+	var messages []BlobMessage
+	before := ""
+	for {
+		batch, err := b.dg.ChannelMessages(b.dataChannel.ID, MaxDiscordMessageRequest, before, "", "")
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range batch {
+			message := BlobMessage{ID: msg.ID, Time: msg.Timestamp}
+			for _, attachment := range msg.Attachments {
+				message.Blobs = append(message.Blobs, attachment.ID)
+				message.Size += int64(attachment.Size)
+			}
+			messages = append(messages, message)
+		}
+		if len(batch) != MaxDiscordMessageRequest {
+			return messages, nil
+		}
+		// Messages are in reverse order
+		before = batch[len(batch)-1].ID
+	}
+}
+
+// DeleteBlobMessage deletes a message of the data channel
+func (b *DiscordBackend) DeleteBlobMessage(id string) error {
+	return b.dg.ChannelMessageDelete(b.dataChannel.ID, id)
+}
+
+// AppendTxs sends tx batches as attachments of a single message
+// Every batch shares the ID of the message since pins are per message.
+func (b *DiscordBackend) AppendTxs(batches [][]byte) ([]string, error) {
+	msg, err := b.sendFiles(b.txChannel.ID, TxChannelName, batches)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(batches))
+	for i := range ids {
+		ids[i] = msg.ID
+	}
+	return ids, nil
+}
+
+// AppendLease sends a lease message to the tx channel
+// Lease messages have no attachments, so they are never read as tx batches.
+func (b *DiscordBackend) AppendLease(data []byte) (string, error) {
+	msg, err := b.dg.ChannelMessageSendComplex(b.txChannel.ID, &discordgo.MessageSend{
+		Content: LeaseMessagePrefix + string(data),
+	})
+	if err != nil {
+		return "", err
+	}
+	return msg.ID, nil
+}
+
+// DeleteLease deletes a lease message of the tx channel
+func (b *DiscordBackend) DeleteLease(id string) error {
+	return b.dg.ChannelMessageDelete(b.txChannel.ID, id)
+}
+
+// ListLeases lists the lease messages of the tx channel sent since a time
+func (b *DiscordBackend) ListLeases(since time.Time) ([]LeaseRecord, error) {
+	var records []LeaseRecord
+	before := ""
+	for {
+		batch, err := b.dg.ChannelMessages(b.txChannel.ID, MaxDiscordMessageRequest, before, "", "")
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range batch {
+			if msg.Timestamp.Before(since) {
+				sortLeases(records)
+				return records, nil
+			}
+			if strings.HasPrefix(msg.Content, LeaseMessagePrefix) && len(msg.Attachments) == 0 {
+				data := []byte(strings.TrimPrefix(msg.Content, LeaseMessagePrefix))
+				records = append(records, LeaseRecord{ID: msg.ID, Time: msg.Timestamp, Data: data})
+			}
+		}
+		if len(batch) != MaxDiscordMessageRequest {
+			sortLeases(records)
+			return records, nil
+		}
+		// Messages are in reverse order
+		before = batch[len(batch)-1].ID
+	}
+}
+
+// sendFiles sends data as attachments of a single message
+func (b *DiscordBackend) sendFiles(channelID string, filename string, data [][]byte) (*discordgo.Message, error) {
+	var files []*discordgo.File
+	for _, d := range data {
+		files = append(files, &discordgo.File{
+			Name:   filename,
+			Reader: bytes.NewReader(d),
+		})
+	}
+	msg, err := b.dg.ChannelMessageSendComplex(channelID, &discordgo.MessageSend{Files: files})
+	if err != nil {
+		return nil, err
+	}
+	if len(msg.Attachments) != len(data) {
+		return nil, errors.New("attachment count mismatch")
+	}
+	return msg, nil
+}
+
+// ListTxs downloads every tx batch from the latest pinned message onwards
+//
+// We check for the lastPinTimestamp to see which TX to start from
+// this is not necessary, but if we need to speed up DB setup we can
+// compress multiple TXs into one message and re-pin to the new starting
+// TX.
+func (b *DiscordBackend) ListTxs() ([]TxRecord, error) {
+	if b.txChannel.LastPinTimestamp == nil {
+		return nil, nil
+	}
+
+	b.pinLock.Lock()
+	pinnedMsgs, err := b.dg.ChannelMessagesPinned(b.txChannel.ID)
+	if err != nil {
+		b.pinLock.Unlock()
+		return nil, err
+	}
+	if len(pinnedMsgs) == 0 {
+		b.pinLock.Unlock()
+		return nil, errors.New("pin timestamp found but no pins were found, very weird")
+	}
+
+	// Get the latest pinned message
+	pinned := pinnedMsgs[len(pinnedMsgs)-1]
+	b.pinnedMsg = pinned
+	b.pinLock.Unlock()
+	messages, err := b.messagesAfter(pinned.ID)
+	if err != nil {
+		return nil, err
+	}
+	return b.messageRecords(append([]*discordgo.Message{pinned}, messages...))
+}
+
+// messagesAfter lists the messages of the tx channel sent after id in the
+// order they were sent
+func (b *DiscordBackend) messagesAfter(id string) ([]*discordgo.Message, error) {
+	var messages []*discordgo.Message
+	for {
+		batch, err := b.dg.ChannelMessages(
+			b.txChannel.ID,
+			MaxDiscordMessageRequest,
+			"", id, "",
+		)
+		if err != nil {
+			return nil, err
+		}
+		if len(batch) == 0 {
+			return messages, nil
+		}
+
+		// Messages are in reverse order
+		for i, j := 0, len(batch)-1; i < j; i, j = i+1, j-1 {
+			batch[i], batch[j] = batch[j], batch[i]
+		}
+		messages = append(messages, batch...)
+		id = batch[len(batch)-1].ID
+
+		if len(batch) != MaxDiscordMessageRequest {
+			return messages, nil
+		}
+	}
+}
+
+// PinnedCheckpoint looks up the latest pinned message of the tx channel
+func (b *DiscordBackend) PinnedCheckpoint() (string, error) {
+	b.pinLock.Lock()
+	defer b.pinLock.Unlock()
+	if b.txChannel.LastPinTimestamp == nil && b.pinnedMsg == nil {
+		return "", nil
+	}
+	pinnedMsgs, err := b.dg.ChannelMessagesPinned(b.txChannel.ID)
+	if err != nil {
+		return "", err
+	}
+	if len(pinnedMsgs) == 0 {
+		return "", nil
+	}
+	b.pinnedMsg = pinnedMsgs[len(pinnedMsgs)-1]
+	return b.pinnedMsg.ID, nil
+}
+
+// ListTxsAfter downloads every tx batch sent after the message with id
+func (b *DiscordBackend) ListTxsAfter(id string) ([]TxRecord, error) {
+	messages, err := b.messagesAfter(id)
+	if err != nil {
+		return nil, err
+	}
+	return b.messageRecords(messages)
+}
+
+// ListTxIDsAfter lists the IDs of the messages with tx batches sent after the
+// message with id
+func (b *DiscordBackend) ListTxIDsAfter(id string) ([]string, error) {
+	messages, err := b.messagesAfter(id)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, m := range messages {
+		// Lease messages have no tx batches
+		if len(m.Attachments) != 0 {
+			ids = append(ids, m.ID)
+		}
+	}
+	return ids, nil
+}
+
+// PinCheckpoint pins the message with id and unpins the previous start point
+func (b *DiscordBackend) PinCheckpoint(id string) error {
+	b.pinLock.Lock()
+	defer b.pinLock.Unlock()
+	err := b.dg.ChannelMessagePin(b.txChannel.ID, id)
+	if err != nil {
+		return err
+	}
+	oldMsg := b.pinnedMsg
+	b.pinnedMsg = &discordgo.Message{ID: id}
+	if oldMsg == nil || oldMsg.ID == id {
+		return nil
+	}
+	err = b.dg.ChannelMessageUnpin(b.txChannel.ID, oldMsg.ID)
+	if err != nil {
+		return errors.New("failed to unpin old transaction start point, please manually unpin old pinned messages")
+	}
+	return nil
+}
+
+// messageRecords downloads the tx batches attached to messages
+func (b *DiscordBackend) messageRecords(ms []*discordgo.Message) ([]TxRecord, error) {
+	var records []TxRecord
+	for _, m := range ms {
+		for _, file := range m.Attachments {
+			data, err := b.cdn.Get(signedAttachmentURL(m.ChannelID, file.ID, file.Filename, file.URL), nil)
+			if err != nil {
+				return nil, fmt.Errorf("tx batch %s, %w", m.ID, err)
+			}
+			records = append(records, TxRecord{ID: m.ID, Time: m.Timestamp, Data: data})
+		}
+	}
+	return records, nil
+}
+
+// SubscribeTxs applies the tx batches of other clients to fs
+func (b *DiscordBackend) SubscribeTxs(fs *Dsfs) {
+	b.live.Store(fs)
+}
+
+func (b *DiscordBackend) messageCreate(s *discordgo.Session, m *discordgo.MessageCreate) {
+	// Not ready to accept TXs
+	live := b.live.Load()
+	if live == nil {
+		return
+	}
+
+	// Don't handle the bot's own TXs or listen to a non-TX channel
+	if m.Author.ID == s.State.User.ID || m.ChannelID != b.txChannel.ID {
+		return
+	}
+	// Lease messages have no tx batches
+	if len(m.Attachments) == 0 {
+		return
+	}
+
+	// There is potentially some issues when doing this
+	// In this current state, open files will not be affected
+	// by any TXs broadcasted by remote clients
+	records, err := b.messageRecords([]*discordgo.Message{m.Message})
+	if err != nil {
+		zap.S().Errorw("failed to download remote txs", "error", err)
+		return
+	}
+	err = applyMessageTxs(live.db, live.volume, records, nil, live)
+	if err != nil {
+		zap.S().Errorw("failed to apply remote txs", "error", err)
+	}
+}
+
+// prepareChannels prepares the tx and data channels
+// creating channels if necessary
+func prepareChannels(dg *discordgo.Session, guildID string) (*discordgo.Channel, *discordgo.Channel, error) {
+	channels, err := dg.GuildChannels(guildID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Find existing channels
+	channelMap := map[string]*discordgo.Channel{
+		DataChannelName: nil,
+		TxChannelName:   nil,
+	}
+	for _, channel := range channels {
+		if _, ok := channelMap[channel.Name]; ok {
+			channelMap[channel.Name] = channel
+		}
+	}
+
+	// Create missing channels
+	for name, channel := range channelMap {
+		if channel == nil {
+			create, err := dg.GuildChannelCreate(guildID, name, discordgo.ChannelTypeGuildText)
+			if err != nil {
+				return nil, nil, err
+			}
+			channelMap[name] = create
+		}
+	}
+
+	return channelMap[TxChannelName], channelMap[DataChannelName], nil
+}
+
+// LocalBackend implements Backend backed by files in a local directory
+//
+// Blocks are stored in the data folder and tx batches in the tx folder.
+// IDs are zero padded, monotonically increasing timestamps so that listing a
+// folder in lexical order returns the batches in the order they were written.
+type LocalBackend struct {
+	dir    string
+	lastID uint64
+	lock   sync.Mutex
+}
+
+// NewLocalBackend creates a new LocalBackend rooted at dir
+func NewLocalBackend(dir string) (*LocalBackend, error) {
+	if dir == "" {
+		return nil, errors.New("local backend requires a directory")
+	}
+	for _, name := range []string{DataChannelName, TxChannelName, LeaseFolderName} {
+		err := os.MkdirAll(filepath.Join(dir, name), 0o755)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &LocalBackend{dir: dir}, nil
+}
+
+// nextID generates the next ID for a stored file
+func (b *LocalBackend) nextID() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	id := uint64(time.Now().UnixNano())
+	if id <= b.lastID {
+		id = b.lastID + 1
+	}
+	b.lastID = id
+	return fmt.Sprintf("%020d", id)
+}
+
+// localIDTime returns the time an ID was generated
+func localIDTime(id string) (time.Time, bool) {
+	nanos, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(nanos)), true
+}
+
+func (b *LocalBackend) putFiles(folder string, data [][]byte) ([]string, error) {
+	ids := make([]string, len(data))
+	for i, d := range data {
+		id := b.nextID()
+		name := filepath.Join(b.dir, folder, id)
+		// Write to a temporary file first so readers never see partial files
+		err := os.WriteFile(name+".tmp", d, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		err = os.Rename(name+".tmp", name)
+		if err != nil {
+			return nil, err
+		}
+		ids[i] = id
+	}
+	return ids, nil
+}
+
+// PutBlobs writes data blocks to the data folder
+func (b *LocalBackend) PutBlobs(blobs [][]byte) ([]BlobRef, error) {
+	ids, err := b.putFiles(DataChannelName, blobs)
+	if err != nil {
+		return nil, err
+	}
+	refs := make([]BlobRef, len(ids))
+	for i, id := range ids {
+		refs[i] = BlobRef{ID: id}
+	}
+	return refs, nil
+}
+
+// GetBlob reads a data block and writes to buffer
+func (b *LocalBackend) GetBlob(ref BlobRef, buffer []byte) (int, error) {
+	if strings.ContainsAny(ref.ID, `/\`) {
+		return 0, fmt.Errorf("invalid blob id %q", ref.ID)
+	}
+	data, err := os.ReadFile(filepath.Join(b.dir, DataChannelName, ref.ID))
+	if err != nil {
+		return 0, err
+	}
+	return copy(buffer, data), nil
+}
+
+// ListBlobMessages lists every data block, each stored in its own message
+func (b *LocalBackend) ListBlobMessages() ([]BlobMessage, error) {
+	entries, err := os.ReadDir(filepath.Join(b.dir, DataChannelName))
+	if err != nil {
+		return nil, err
+	}
+	var messages []BlobMessage
+	for _, entry := range entries {
+		id := entry.Name()
+		if _, err := strconv.ParseUint(id, 10, 64); err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, BlobMessage{
+			ID:    id,
+			Time:  info.ModTime(),
+			Blobs: []string{id},
+			Size:  info.Size(),
+		})
+	}
+	return messages, nil
+}
+
+// DeleteBlobMessage deletes a data block
+func (b *LocalBackend) DeleteBlobMessage(id string) error {
+	if strings.ContainsAny(id, `/\`) {
+		return fmt.Errorf("invalid blob id %q", id)
+	}
+	return os.Remove(filepath.Join(b.dir, DataChannelName, id))
+}
+
+// AppendTxs writes tx batches to the tx folder
+func (b *LocalBackend) AppendTxs(batches [][]byte) ([]string, error) {
+	return b.putFiles(TxChannelName, batches)
+}
+
+// ListTxs reads every tx batch from the pinned checkpoint onwards
+func (b *LocalBackend) ListTxs() ([]TxRecord, error) {
+	pinID, err := b.PinnedCheckpoint()
+	if err != nil || pinID == "" {
+		return nil, err
+	}
+	return b.listTxs(func(id string) bool { return id >= pinID })
+}
+
+// ListTxsAfter reads every tx batch written after the batch with id
+func (b *LocalBackend) ListTxsAfter(id string) ([]TxRecord, error) {
+	return b.listTxs(func(other string) bool { return other > id })
+}
+
+// ListTxIDsAfter lists the IDs of the tx batches written after the batch
+// with id
+func (b *LocalBackend) ListTxIDsAfter(id string) ([]string, error) {
+	return b.txIDs(func(other string) bool { return other > id })
+}
+
+// PinnedCheckpoint reads the ID of the pinned checkpoint
+func (b *LocalBackend) PinnedCheckpoint() (string, error) {
+	pin, err := os.ReadFile(filepath.Join(b.dir, "pin"))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(pin)), nil
+}
+
+// listTxs reads the tx batches with selected IDs in the order they were
+// written
+func (b *LocalBackend) listTxs(selected func(id string) bool) ([]TxRecord, error) {
+	ids, err := b.txIDs(selected)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]TxRecord, 0, len(ids))
+	for _, id := range ids {
+		data, err := os.ReadFile(filepath.Join(b.dir, TxChannelName, id))
+		if err != nil {
+			return nil, fmt.Errorf("tx batch %s, %w", id, err)
+		}
+		sent, _ := localIDTime(id)
+		records = append(records, TxRecord{ID: id, Time: sent, Data: data})
+	}
+	return records, nil
+}
+
+// txIDs lists the selected IDs of tx batches in the order they were written
+func (b *LocalBackend) txIDs(selected func(id string) bool) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(b.dir, TxChannelName))
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, entry := range entries {
+		id := entry.Name()
+		if _, err := strconv.ParseUint(id, 10, 64); err != nil {
+			continue
+		}
+		if selected(id) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// AppendLease writes a lease message to the lease folder
+func (b *LocalBackend) AppendLease(data []byte) (string, error) {
+	ids, err := b.putFiles(LeaseFolderName, [][]byte{data})
+	if err != nil {
+		return "", err
+	}
+	return ids[0], nil
+}
+
+// DeleteLease removes a lease message from the lease folder
+func (b *LocalBackend) DeleteLease(id string) error {
+	if strings.ContainsAny(id, `/\`) {
+		return fmt.Errorf("invalid lease id %q", id)
+	}
+	return os.Remove(filepath.Join(b.dir, LeaseFolderName, id))
+}
+
+// ListLeases reads the lease messages written since a time
+// The time of a message is the timestamp of its ID.
+func (b *LocalBackend) ListLeases(since time.Time) ([]LeaseRecord, error) {
+	entries, err := os.ReadDir(filepath.Join(b.dir, LeaseFolderName))
+	if err != nil {
+		return nil, err
+	}
+	var records []LeaseRecord
+	for _, entry := range entries {
+		id := entry.Name()
+		sent, ok := localIDTime(id)
+		if !ok {
+			continue
+		}
+		if sent.Before(since) {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(b.dir, LeaseFolderName, id))
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, LeaseRecord{ID: id, Time: sent, Data: data})
+	}
+	sortLeases(records)
+	return records, nil
+}
+
+// PinCheckpoint records id as the start of the log
+func (b *LocalBackend) PinCheckpoint(id string) error {
+	name := filepath.Join(b.dir, "pin")
+	err := os.WriteFile(name+".tmp", []byte(id), 0o644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalBackend(t *testing.T) {
+	backend, err := NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refs, err := backend.PutBlobs([][]byte{[]byte("hello"), []byte("world")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 2 || refs[0] == refs[1] {
+		t.Fatalf("unexpected blob refs %v", refs)
+	}
+	buffer := make([]byte, 16)
+	n, err := backend.GetBlob(refs[1], buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buffer[:n]) != "world" {
+		t.Errorf("got blob %q, want %q", buffer[:n], "world")
+	}
+
+	records, err := backend.ListTxs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 0 {
+		t.Fatalf("expected no records before a checkpoint is pinned, got %d", len(records))
+	}
+
+	first, _ := backend.AppendTxs([][]byte{[]byte("a")})
+	second, _ := backend.AppendTxs([][]byte{[]byte("b"), []byte("c")})
+	if err := backend.PinCheckpoint(second[0]); err != nil {
+		t.Fatal(err)
+	}
+	records, err = backend.ListTxs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got [][]byte
+	for _, record := range records {
+		if record.ID == first[0] {
+			t.Errorf("record %s is before the checkpoint", record.ID)
+		}
+		got = append(got, record.Data)
+	}
+	if !bytes.Equal(bytes.Join(got, nil), []byte("bc")) {
+		t.Errorf("got records %q, want %q", got, []string{"b", "c"})
+	}
+
+	// Unreadable batches fail the listing instead of being skipped
+	name := filepath.Join(backend.dir, TxChannelName, second[1])
+	if err := os.Remove(name); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(name, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backend.ListTxs(); err == nil {
+		t.Error("listed the tx log with an unreadable batch")
+	}
+}
+
+func TestSetupDBCompaction(t *testing.T) {
+	backend, err := NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := setupDB(backend, NewVolume("", false), false, "map")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := db.Get("/"); !ok {
+		t.Fatal("root folder was not initialized")
+	}
+
+	var batches [][]byte
+	for _, tx := range []Tx{
+		{Tx: WriteTx, Path: "/a", Type: FolderType},
+		{Tx: WriteTx, Path: "/a/b", Type: FileType, Size: 1},
+		{Tx: WriteTx, Path: "/c", Type: FileType, Size: 2},
+		createDeleteTx("/c"),
+	} {
+		b, _ := json.Marshal(tx)
+		batches = append(batches, b)
+	}
+	if _, err := backend.AppendTxs(batches); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = setupDB(backend, NewVolume("", false), true, "radix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := backend.ListTxs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("expected compaction into 1 record, got %d", len(records))
+	}
+
+	db = GetNewDB("map")
+	if err := applyMessageTxs(db, NewVolume("", false), records, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]bool{"/": true, "/a": true, "/a/b": true, "/c": false} {
+		if _, ok := db.Get(path); ok != want {
+			t.Errorf("path %s exists = %v, want %v", path, ok, want)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"go.uber.org/zap"
+)
+
+// Attachment download settings
+const (
+	CDNRetries    = 5
+	CDNBackoff    = 500 * time.Millisecond
+	CDNMaxBackoff = 30 * time.Second
+	CDNTimeout    = 2 * time.Minute
+	// URLExpiryMargin is how long before their expiry signed URLs are
+	// no longer used
+	URLExpiryMargin = time.Minute
+)
+
+// StatusError is returned for attachment downloads that do not succeed
+type StatusError struct {
+	URL        string
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("GET %s returned %d %s", e.URL, e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// retryable reports whether a request may succeed if it is sent again
+func (e *StatusError) retryable() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= http.StatusInternalServerError
+}
+
+// CDNClient downloads attachments and retries transient failures
+type CDNClient struct {
+	client  *fasthttp.Client
+	retries int
+	backoff time.Duration
+	timeout time.Duration
+}
+
+// NewCDNClient creates a new CDNClient
+func NewCDNClient() *CDNClient {
+	return &CDNClient{
+		client: &fasthttp.Client{
+			ReadTimeout:  CDNTimeout,
+			WriteTimeout: CDNTimeout,
+			// Attachments are at most MaxDiscordFileSize
+			MaxResponseBodySize: MaxDiscordFileSize + 1<<20,
+		},
+		retries: CDNRetries,
+		backoff: CDNBackoff,
+		timeout: CDNTimeout,
+	}
+}
+
+// Get downloads url and appends the body to dst
+// Network errors, 429 and 5xx responses are retried with exponential backoff
+// and jitter, other responses fail immediately.
+func (c *CDNClient) Get(url string, dst []byte) ([]byte, error) {
+	backoff := c.backoff
+	for attempt := 1; ; attempt++ {
+		body, wait, err := c.get(url, dst)
+		if err == nil {
+			return body, nil
+		}
+		if statusErr, ok := err.(*StatusError); ok && !statusErr.retryable() {
+			return nil, err
+		}
+		if attempt > c.retries {
+			return nil, fmt.Errorf("%w, gave up after %d attempts", err, attempt)
+		}
+
+		// Full jitter unless the server asked for a specific delay
+		if wait <= 0 {
+			wait = time.Duration(rand.Int63n(int64(backoff) + 1))
+			backoff *= 2
+			if backoff > CDNMaxBackoff {
+				backoff = CDNMaxBackoff
+			}
+		}
+		zap.S().Warnw("attachment download failed, retrying",
+			"url", url, "attempt", attempt, "wait", wait, "error", err,
+		)
+		time.Sleep(wait)
+	}
+}
+
+// get sends a single request and returns the Retry-After delay on failure
+func (c *CDNClient) get(url string, dst []byte) ([]byte, time.Duration, error) {
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.SetRequestURI(url)
+	req.Header.SetMethod(fasthttp.MethodGet)
+	if err := c.client.DoTimeout(req, resp, c.timeout); err != nil {
+		return nil, 0, err
+	}
+	if resp.StatusCode() != fasthttp.StatusOK {
+		return nil, retryAfter(string(resp.Header.Peek("Retry-After"))), &StatusError{URL: url, StatusCode: resp.StatusCode()}
+	}
+	return append(dst, resp.Body()...), 0, nil
+}
+
+// retryAfter parses a Retry-After header given in seconds or as a date
+func retryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		wait := time.Duration(seconds * float64(time.Second))
+		if wait > CDNMaxBackoff {
+			wait = CDNMaxBackoff
+		}
+		return wait
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		wait := time.Until(date)
+		if wait > CDNMaxBackoff {
+			wait = CDNMaxBackoff
+		}
+		return wait
+	}
+	return 0
+}
+
+// signedURL is a signed attachment URL and its expiry
+type signedURL struct {
+	url    string
+	expiry time.Time
+}
+
+// URLCache stores signed attachment URLs until they expire
+type URLCache struct {
+	urls map[string]signedURL
+	lock sync.Mutex
+}
+
+// NewURLCache creates a new URLCache
+func NewURLCache() *URLCache {
+	return &URLCache{urls: make(map[string]signedURL)}
+}
+
+// Put caches the signed URL of attachment id
+// URLs without an expiry are not cached.
+func (c *URLCache) Put(id string, signed string) {
+	expiry, ok := urlExpiry(signed)
+	if !ok {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.urls[id] = signedURL{url: signed, expiry: expiry}
+}
+
+// Get returns the signed URL of attachment id unless it is about to expire
+func (c *URLCache) Get(id string) (string, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	signed, ok := c.urls[id]
+	if !ok {
+		return "", false
+	}
+	if time.Now().Add(URLExpiryMargin).After(signed.expiry) {
+		delete(c.urls, id)
+		return "", false
+	}
+	return signed.url, true
+}
+
+// Delete removes the signed URL of attachment id
+func (c *URLCache) Delete(id string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.urls, id)
+}
+
+// urlExpiry parses the expiry of a signed URL from its hex ex parameter
+func urlExpiry(signed string) (time.Time, bool) {
+	u, err := url.Parse(signed)
+	if err != nil {
+		return time.Time{}, false
+	}
+	ex, err := strconv.ParseInt(u.Query().Get("ex"), 16, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(ex, 0), true
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCDNClient(t *testing.T) {
+	var requests atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := requests.Add(1)
+		switch {
+		case r.URL.Path == "/missing":
+			http.NotFound(w, r)
+		case n == 1:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+		case n == 2:
+			w.WriteHeader(http.StatusBadGateway)
+		default:
+			w.Write([]byte("attachment"))
+		}
+	}))
+	defer server.Close()
+
+	c := NewCDNClient()
+	c.backoff = time.Millisecond
+	body, err := c.Get(server.URL+"/file", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "attachment" || requests.Load() != 3 {
+		t.Errorf("got %q after %d requests", body, requests.Load())
+	}
+
+	// Error bodies are never returned as data
+	requests.Store(0)
+	_, err = c.Get(server.URL+"/missing", nil)
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusNotFound {
+		t.Errorf("expected a 404 error, got %v", err)
+	}
+	if requests.Load() != 1 {
+		t.Errorf("permanent error was retried %d times", requests.Load()-1)
+	}
+
+	// Persistent transient errors give up eventually
+	c.retries = 2
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	if _, err := c.Get(failing.URL, nil); err == nil {
+		t.Error("expected persistent 503 to fail")
+	}
+
+	if wait := retryAfter("1.5"); wait != 1500*time.Millisecond {
+		t.Errorf("got Retry-After %s", wait)
+	}
+	if wait := retryAfter("3600"); wait != CDNMaxBackoff {
+		t.Errorf("Retry-After was not capped, got %s", wait)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import "math/bits"
+
+// Content-defined chunk sizes
+// Chunks never exceed FileBlockSize so that they fit in a single attachment.
+const (
+	MinChunkSize = 2 << 20
+	AvgChunkSize = 4 << 20
+	MaxChunkSize = FileBlockSize
+)
+
+// Masks for normalized chunking
+// Cut points are harder to find before AvgChunkSize and easier after it,
+// which narrows the distribution of chunk sizes around the average.
+// The masks select the high bits of the gear hash, which depend on the
+// last 64 bytes.
+var (
+	chunkMaskS = ^uint64(0) << (64 - bits.Len(AvgChunkSize) - 1)
+	chunkMaskL = ^uint64(0) << (64 - bits.Len(AvgChunkSize) + 3)
+)
+
+// gearTable maps bytes to random values for the gear hash
+// The table is generated from a fixed seed since every client has to cut
+// identical content at identical offsets.
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	state := uint64(0x6473667363686e6b)
+	for i := range table {
+		// splitmix64
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// cutChunk returns the length of the first chunk of data using FastCDC
+func cutChunk(data []byte) int {
+	n := len(data)
+	if n <= MinChunkSize {
+		return n
+	}
+	if n > MaxChunkSize {
+		n = MaxChunkSize
+	}
+	normal := AvgChunkSize
+	if n < normal {
+		normal = n
+	}
+
+	var fp uint64
+	i := MinChunkSize
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&chunkMaskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&chunkMaskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
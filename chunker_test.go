@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"math/rand"
+	"testing"
+)
+
+// chunkSums splits data into chunks and returns their checksums
+func chunkSums(data []byte) [][20]byte {
+	var sums [][20]byte
+	for len(data) > 0 {
+		n := cutChunk(data)
+		if n > MaxChunkSize || (n < MinChunkSize && n != len(data)) {
+			panic("chunk size out of bounds")
+		}
+		sums = append(sums, sha1.Sum(data[:n]))
+		data = data[n:]
+	}
+	return sums
+}
+
+func TestCutChunk(t *testing.T) {
+	data := make([]byte, 48<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	before := chunkSums(data)
+	after := chunkSums(append([]byte{0}, data...))
+	if len(before) < 4 {
+		t.Fatalf("expected several chunks, got %d", len(before))
+	}
+
+	// Only the chunk containing the inserted byte changes
+	seen := make(map[[20]byte]bool)
+	for _, sum := range before {
+		seen[sum] = true
+	}
+	changed := 0
+	for _, sum := range after {
+		if !seen[sum] {
+			changed++
+		}
+	}
+	if changed > 1 {
+		t.Errorf("inserting a byte changed %d of %d chunks", changed, len(after))
+	}
+
+	if n := cutChunk(bytes.Repeat([]byte{1}, 1024)); n != 1024 {
+		t.Errorf("small input was split at %d", n)
+	}
+}
+
+func TestTxOffsets(t *testing.T) {
+	// Txs without lengths use fixed size blocks
+	tx := &Tx{FileIDs: []string{"a", "b"}, Size: FileBlockSize + 10}
+	offsets := tx.Offsets()
+	if offsets[1] != FileBlockSize || offsets[2] != FileBlockSize+10 {
+		t.Errorf("unexpected offsets %v", offsets)
+	}
+
+	tx = &Tx{FileIDs: []string{"a", "b"}, Lengths: []int64{3, 5}, Size: 8}
+	offsets = tx.Offsets()
+	if offsets[1] != 3 || offsets[2] != 8 {
+		t.Errorf("unexpected offsets %v", offsets)
+	}
+}
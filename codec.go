@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec identifies how a data block is encoded
+type Codec int
+
+const (
+	RawCodec Codec = iota
+	ZstdCodec
+)
+
+// Encoders and decoders are safe for concurrent use with EncodeAll and
+// DecodeAll so they are shared by all blocks.
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(FileBlockSize))
+)
+
+// GetCodec returns the codec for a codec name
+func GetCodec(name string) Codec {
+	switch name {
+	case "none":
+		return RawCodec
+	case "zstd":
+		return ZstdCodec
+	default:
+		panic("unknown codec")
+	}
+}
+
+// encodeBlock encodes a block with codec
+// Blocks that do not shrink are kept raw.
+func encodeBlock(data []byte, codec Codec) ([]byte, Codec) {
+	switch codec {
+	case ZstdCodec:
+		encoded := zstdEncoder.EncodeAll(data, make([]byte, 0, len(data)))
+		if len(encoded) < len(data) {
+			return encoded, ZstdCodec
+		}
+	}
+	return data, RawCodec
+}
+
+// decodeBlock decodes a block with codec and writes to buffer
+func decodeBlock(data []byte, codec Codec, buffer []byte) (int, error) {
+	switch codec {
+	case RawCodec:
+		return copy(buffer, data), nil
+	case ZstdCodec:
+		decoded, err := zstdDecoder.DecodeAll(data, make([]byte, 0, len(buffer)))
+		if err != nil {
+			return 0, err
+		}
+		if len(decoded) > len(buffer) {
+			return 0, errors.New("decoded block is larger than buffer")
+		}
+		return copy(buffer, decoded), nil
+	default:
+		return 0, fmt.Errorf("unknown codec %d", codec)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestCodec(t *testing.T) {
+	random := make([]byte, 1024)
+	rand.Read(random)
+
+	for name, block := range map[string][]byte{
+		"text":   bytes.Repeat([]byte("compressible "), 1000),
+		"random": random,
+		"empty":  {},
+	} {
+		data, codec := encodeBlock(block, ZstdCodec)
+		if name == "text" && codec != ZstdCodec {
+			t.Errorf("%s: expected block to be compressed", name)
+		}
+		if name == "random" && codec != RawCodec {
+			t.Errorf("%s: expected incompressible block to be kept raw", name)
+		}
+		buffer := make([]byte, len(block))
+		n, err := decodeBlock(data, codec, buffer)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(buffer[:n], block) {
+			t.Errorf("%s: decoded block does not match", name)
+		}
+	}
+
+	// Old txs without codecs are raw
+	tx := &Tx{FileIDs: []string{"a", "b"}}
+	if tx.Codec(1) != RawCodec {
+		t.Error("expected missing codec to be raw")
+	}
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// runCheck reads every block of the volume and prints degraded and lost files
+// The exit code is non-zero if a file cannot be recovered.
+func runCheck(fs *Dsfs) int {
+	files, degraded, lost := fs.CheckVolume()
+	for _, path := range degraded {
+		fmt.Println("degraded", path)
+	}
+	for _, path := range lost {
+		fmt.Println("lost", path)
+	}
+	zap.S().Infow("check done", "files", files, "degraded", len(degraded), "lost", len(lost))
+	if len(lost) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// runMigrate rewrites the tx log into the current format by compacting it
+// into the txs of the tree
+// Files written before message IDs were stored in txs also record the
+// message of every block so that their URLs can be refreshed. Versions only
+// kept in the log are dropped, and other clients must not write while the
+// log is rewritten.
+func runMigrate(fs *Dsfs, backend Backend) int {
+	if err := fs.leaser.Acquire(false); err != nil {
+		zap.S().Errorw("failed to acquire the volume lease", "error", err)
+		return 1
+	}
+	defer fs.leaser.Release()
+
+	fs.lock.Lock()
+	txs := fs.treeTxs()
+	fs.lock.Unlock()
+
+	outdated := fs.volume.Version() < TxFormatVersion
+	var unlocated []int
+	for i, tx := range txs {
+		outdated = outdated || tx.Version < TxFormatVersion
+		if tx.Type == FileType && len(tx.FileIDs) > 0 && !tx.located() {
+			unlocated = append(unlocated, i)
+		}
+	}
+
+	failed := 0
+	located := 0
+	if locator, ok := backend.(BlobLocator); ok && len(unlocated) > 0 {
+		messages, err := locator.LocateBlobs()
+		if err != nil {
+			zap.S().Errorw("failed to list data messages", "error", err)
+			return 1
+		}
+		for _, i := range unlocated {
+			tx, missing := locateTx(txs[i], messages)
+			if missing != "" {
+				zap.S().Errorw("block is missing from the data channel", "path", txs[i].Path, "id", missing)
+				failed++
+				continue
+			}
+			txs[i] = tx
+			located++
+		}
+	}
+	code := 0
+	if failed > 0 {
+		code = 1
+	}
+	if !outdated && located == 0 {
+		zap.S().Infow("volume is up to date, nothing to migrate", "failed", failed)
+		return code
+	}
+
+	fs.volume.root.Version = TxFormatVersion
+	for i, tx := range txs {
+		migrated := *tx
+		migrated.Version = TxFormatVersion
+		txs[i] = &migrated
+	}
+	lines := encodeTxLines(txs)
+	if !fs.leaser.Held() {
+		zap.S().Error("lost the volume lease, not rewriting the tx log")
+		return 1
+	}
+	ids, err := compactTxs(backend, fs.volume, lines)
+	if err != nil {
+		zap.S().Errorw("failed to rewrite the tx log", "error", err)
+		return 1
+	}
+
+	fs.lock.Lock()
+	for i, tx := range txs {
+		current, _ := fs.db.Get(tx.Path)
+		fs.db.Insert(tx.Path, tx)
+		fs.db.SetMessage(tx.Path, ids[i])
+		fs.volume.blocks.Replace(current, tx)
+	}
+	fs.lock.Unlock()
+
+	zap.S().Infow("migrate done", "txs", len(txs), "located", located, "failed", failed)
+	return code
+}
+
+// runRestore publishes a version of a file as its current tx
+// The blocks of the version are reused, so nothing is uploaded.
+func runRestore(fs *Dsfs, backend Backend, path string, name string) int {
+	if !writable(fs.leaser) {
+		return 1
+	}
+	version, ok := findVersion(fs.volume.versions, path, name)
+	if !ok {
+		zap.S().Errorw("version not found", "path", path, "version", name)
+		for _, n := range versionNames(fs.volume.versions.Get(path)) {
+			fmt.Println(n)
+		}
+		return 1
+	}
+	fs.lock.Lock()
+	parent, ok := fs.db.Get(getDir(path))
+	current, exists := fs.db.Get(path)
+	fs.lock.Unlock()
+	if !ok || parent.Type != FolderType {
+		zap.S().Errorw("parent folder does not exist", "path", getDir(path))
+		return 1
+	}
+	if exists && current.Type != FileType {
+		zap.S().Errorw("path is a folder", "path", path)
+		return 1
+	}
+
+	tx := *version
+	tx.Tx = WriteTx
+	tx.Mtim = time.Now()
+	ids, err := backend.AppendTxs([][]byte{encodeTx(tx)})
+	if err != nil {
+		zap.S().Errorw("failed to publish version", "error", err)
+		return 1
+	}
+	zap.S().Infow("restore done", "path", path, "version", name, "id", ids[0])
+	return 0
+}
+
+// runTrashList prints the items in the trash with their deletion time and
+// the path they were deleted from
+func runTrashList(fs *Dsfs) int {
+	fs.lock.Lock()
+	items := fs.trashItems()
+	fs.lock.Unlock()
+	for _, item := range items {
+		deleted, path := "-", "-"
+		if item.Trashed != nil {
+			deleted = item.Trashed.Time.Format(time.RFC3339)
+			path = item.Trashed.Path
+		}
+		fmt.Println(filepath.Base(item.Path), deleted, path)
+	}
+	return 0
+}
+
+// runTrashRestore moves a trash item back to the path it was deleted from,
+// or to target if set
+func runTrashRestore(fs *Dsfs, name string, target string) int {
+	if !writable(fs.leaser) {
+		return 1
+	}
+	item := TrashDir + "/" + name
+	fs.lock.Lock()
+	tx, ok := fs.db.Get(item)
+	fs.lock.Unlock()
+	if !ok || name == "" || strings.Contains(name, "/") {
+		zap.S().Errorw("trash item not found", "item", name)
+		return 1
+	}
+	if target == "" {
+		if tx.Trashed == nil {
+			zap.S().Errorw("trash item has no original path", "item", name)
+			return 1
+		}
+		target = tx.Trashed.Path
+	}
+	fs.lock.Lock()
+	_, exists := fs.db.Get(target)
+	fs.lock.Unlock()
+	if exists || inTrash(target) {
+		zap.S().Errorw("path already exists", "path", target)
+		return 1
+	}
+
+	b, _, errc := fs.rename(item, target)
+	if errc != 0 {
+		zap.S().Errorw("failed to move trash item", "path", target, "error", errc)
+		return 1
+	}
+	if _, err := fs.writer.SendTx(b); err != nil {
+		zap.S().Errorw("failed to restore trash item", "error", err)
+		return 1
+	}
+	zap.S().Infow("restored trash item", "item", name, "path", target)
+	return 0
+}
+
+// runTrashPurge deletes the trash items deleted before a time for good
+func runTrashPurge(fs *Dsfs, before time.Time) int {
+	if !writable(fs.leaser) {
+		return 1
+	}
+	for _, b := range fs.purgeTrash(before) {
+		if _, err := fs.writer.SendTx(b); err != nil {
+			zap.S().Errorw("failed to purge trash", "error", err)
+			return 1
+		}
+	}
+	return 0
+}
+
+// writable reports whether commands may write to the volume
+func writable(leaser *Leaser) bool {
+	if held, err := leaser.HeldByOther(); err != nil || held {
+		zap.S().Errorw("volume is read-only while another client holds an exclusive lease", "error", err)
+		return false
+	}
+	return true
+}
+
+// locateTx returns a copy of tx with the message of every block, or the ID of
+// a block that was not located
+func locateTx(old *Tx, located map[string]string) (*Tx, string) {
+	tx := *old
+	tx.MessageIDs = make([]string, len(tx.FileIDs))
+	for i, id := range tx.FileIDs {
+		if tx.MessageIDs[i] = located[id]; tx.MessageIDs[i] == "" {
+			return nil, id
+		}
+	}
+	tx.ParityMessageIDs = nil
+	if len(tx.Parity) > 0 {
+		tx.ParityMessageIDs = make([]string, len(tx.Parity))
+	}
+	for i, id := range tx.Parity {
+		if tx.ParityMessageIDs[i] = located[id]; tx.ParityMessageIDs[i] == "" {
+			return nil, id
+		}
+	}
+	return &tx, ""
+}
+
+// runGC deletes data messages whose blocks are not referenced by any file
+// Messages younger than grace are kept since other clients may not have sent
+// the txs referencing them yet. Blocks of the versions kept by the volume are
+// never deleted, and with keepVersions neither are blocks of every version
+// still in the tx log. Only the versions kept by this process count, so clients
+// keeping more versions should run gc with as many.
+// The exclusive lease makes mounted clients read-only within settle, after
+// which the log is replayed again since they may have reused any old block.
+func runGC(backend Backend, volume *Volume, leaser *Leaser, grace time.Duration, settle time.Duration, dryRun bool, keepVersions bool) int {
+	collector, ok := backend.(BlobCollector)
+	if !ok {
+		zap.S().Error("backend cannot delete data blocks")
+		return 1
+	}
+	if !dryRun {
+		if err := leaser.Acquire(true); err != nil {
+			zap.S().Errorw("failed to acquire the volume lease", "error", err)
+			return 1
+		}
+		defer leaser.Release()
+	}
+	start := time.Now()
+
+	referenced := make(map[string]bool)
+	seen, err := referenceBlobs(backend, volume, referenced, nil, keepVersions)
+	if err != nil {
+		zap.S().Errorw("failed to replay the tx log", "error", err)
+		return 1
+	}
+	for _, versions := range volume.versions.All() {
+		for _, tx := range versions {
+			for _, id := range append(append([]string(nil), tx.FileIDs...), tx.Parity...) {
+				referenced[id] = true
+			}
+		}
+	}
+	messages, err := collector.ListBlobMessages()
+	if err != nil {
+		zap.S().Errorw("failed to list data messages", "error", err)
+		return 1
+	}
+	// Txs appended in the meantime may reference any block, including ones
+	// that were unreferenced when the log was first replayed
+	if wait := settle - time.Since(start); !dryRun && wait > 0 {
+		time.Sleep(wait)
+	}
+	if _, err := referenceBlobs(backend, volume, referenced, seen, true); err != nil {
+		zap.S().Errorw("failed to replay the tx log", "error", err)
+		return 1
+	}
+
+	var orphaned []BlobMessage
+	var size int64
+	recent := 0
+	for _, msg := range messages {
+		if start.Sub(msg.Time) < grace {
+			recent++
+			continue
+		}
+		used := false
+		for _, id := range msg.Blobs {
+			used = used || referenced[id]
+		}
+		if !used {
+			orphaned = append(orphaned, msg)
+			size += msg.Size
+		}
+	}
+
+	if dryRun {
+		for _, msg := range orphaned {
+			fmt.Println("orphaned", msg.ID, msg.Size)
+		}
+		fmt.Printf("%d messages, %d bytes reclaimable\n", len(orphaned), size)
+		return 0
+	}
+
+	if !leaser.Held() {
+		zap.S().Error("lost the volume lease, not deleting data messages")
+		return 1
+	}
+	failed := 0
+	for _, msg := range orphaned {
+		if err := collector.DeleteBlobMessage(msg.ID); err != nil {
+			zap.S().Errorw("failed to delete data message", "id", msg.ID, "error", err)
+			failed++
+			size -= msg.Size
+		}
+	}
+	zap.S().Infow("gc done",
+		"deleted", len(orphaned)-failed, "bytes", size, "recent", recent, "failed", failed,
+	)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// referenceBlobs replays the tx log and marks the blocks referenced by the
+// files of the tree, or by every tx if all is set
+// Tx batches in skip are ignored. The IDs of the replayed batches are
+// returned.
+func referenceBlobs(backend Backend, volume *Volume, referenced map[string]bool, skip map[string]bool, all bool) (map[string]bool, error) {
+	records, err := backend.ListTxs()
+	if err != nil {
+		return nil, err
+	}
+	mark := func(tx *Tx) {
+		for _, id := range tx.FileIDs {
+			referenced[id] = true
+		}
+		for _, id := range tx.Parity {
+			referenced[id] = true
+		}
+	}
+
+	seen := make(map[string]bool)
+	files := make(map[string]*Tx)
+	for _, record := range records {
+		seen[record.ID] = true
+		if skip[record.ID] {
+			continue
+		}
+		txs, _, err := readTxs(volume, record)
+		if err != nil {
+			return nil, err
+		}
+		for _, tx := range txs {
+			switch {
+			case tx.Tx == WriteTx && all:
+				mark(tx)
+			case tx.Tx == WriteTx:
+				files[tx.Path] = tx
+			case tx.Tx == DeleteTx:
+				delete(files, tx.Path)
+			}
+		}
+	}
+	for _, tx := range files {
+		mark(tx)
+	}
+	return seen, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestGC(t *testing.T) {
+	dir := t.TempDir()
+	backend := newTestLocalBackend(t, dir)
+	volume := NewVolume("", false)
+	if _, err := setupDB(backend, volume, false, "map"); err != nil {
+		t.Fatal(err)
+	}
+
+	// /a is overwritten and /b is deleted, orphaning their first blocks
+	old := putFile(t, backend, "/a", []byte("old contents"))
+	putFile(t, backend, "/b", []byte("deleted contents"))
+	data := []byte("new contents")
+	putFile(t, backend, "/a", data)
+	b, _ := json.Marshal(createDeleteTx("/b"))
+	if _, err := backend.AppendTxs([][]byte{b}); err != nil {
+		t.Fatal(err)
+	}
+	blocks := func() int {
+		entries, _ := os.ReadDir(filepath.Join(dir, DataChannelName))
+		return len(entries)
+	}
+
+	for _, c := range []struct {
+		grace        time.Duration
+		dryRun, keep bool
+		want         int
+	}{
+		{time.Hour, false, false, 3},
+		{0, true, false, 3},
+		{0, false, true, 3},
+		{0, false, false, 1},
+	} {
+		if code := runGC(backend, volume, NewLeaser(backend), c.grace, 0, c.dryRun, c.keep); code != 0 {
+			t.Fatalf("gc failed with %d", code)
+		}
+		if n := blocks(); n != c.want {
+			t.Errorf("grace %s, dry run %v, keep versions %v, got %d blocks, want %d",
+				c.grace, c.dryRun, c.keep, n, c.want)
+		}
+	}
+
+	fs := newTestDsfs(t, backend)
+	if got := readFile(t, fs, "/a", len(data)); !bytes.Equal(got, data) {
+		t.Errorf("got %q, want %q", got, data)
+	}
+	// Collected blocks are never deduplicated against
+	if _, ok := fs.volume.blocks.Get(old.Checksums[0]); ok {
+		t.Error("overwritten block is still indexed")
+	}
+}
@@ -5,12 +5,18 @@ import "time"
 const (
 	TxChannelName            = "tx"
 	DataChannelName          = "data"
+	LeaseFolderName          = "lease"
+	LeaseMessagePrefix       = "dsfs lease "
 	MaxDiscordFileSize       = 26214400
 	FileBlockSize            = 8388119
 	MaxDiscordMessageRequest = 100
 	MaxDiscordFileCount      = 10
 	PollInterval             = 250 * time.Millisecond
 	MaxRetries               = 20
+	ReadAheadBlocks          = 2
+	MaxConcurrentUploads     = MaxDiscordFileCount
+	BlockRetries             = 3
+	BlockRetryBackoff        = 500 * time.Millisecond
 	QueueTimeout             = 5 * time.Second
 )
 
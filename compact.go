@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Online compaction settings
+const (
+	// CompactInterval is how often the compaction thresholds are checked
+	CompactInterval = time.Minute
+	// CompactTxs is the number of txs in the log beyond one per path that
+	// triggers a compaction
+	CompactTxs = 1000
+	// CompactBytes is the growth of the log since the last snapshot that
+	// triggers a compaction
+	CompactBytes = 16 << 20
+)
+
+// Compactor snapshots the tree of a mounted volume into new tx messages and
+// moves the pin once the log grew past the compaction thresholds
+//
+// FUSE operations keep running while a snapshot is written. Tx batches that
+// are applied in the meantime are recorded and appended again after the
+// snapshot if they ended up before it in the log.
+type Compactor struct {
+	fs      *Dsfs
+	backend Backend
+	// recorded holds the tx batches applied while a snapshot is written
+	recorded  []TxRecord
+	recording bool
+	// last is the ID of the last batch appended by the compactor
+	last string
+	// late holds the tx batches applied after a compaction that have to be
+	// appended again after last, in the order they were applied
+	late      []TxRecord
+	appending bool
+	// appendLock is held while late batches are appended and while a
+	// snapshot is written
+	appendLock sync.Mutex
+	// snapshotBytes is the size of the last snapshot
+	snapshotBytes int64
+	running       bool
+	lock          sync.Mutex
+}
+
+// NewCompactor creates a new Compactor that writes to the unwrapped backend
+func NewCompactor(fs *Dsfs, backend Backend) *Compactor {
+	return &Compactor{fs: fs, backend: backend}
+}
+
+// Run checks the compaction thresholds every interval
+func (c *Compactor) Run(interval time.Duration) {
+	for range time.Tick(interval) {
+		if !c.due() {
+			continue
+		}
+		if err := c.Compact(); err != nil {
+			zap.S().Warnw("online compaction failed", "error", err)
+		}
+	}
+}
+
+// due reports whether the log grew past the compaction thresholds
+func (c *Compactor) due() bool {
+	c.fs.lock.Lock()
+	paths := int64(0)
+	it := c.fs.db.Iterator("/")
+	for _, _, ok := it.Next(); ok; _, _, ok = it.Next() {
+		paths++
+	}
+	c.fs.lock.Unlock()
+
+	c.lock.Lock()
+	snapshotBytes := c.snapshotBytes
+	c.lock.Unlock()
+	volume := c.fs.volume
+	return volume.logTxs.Load() >= paths+CompactTxs ||
+		volume.logBytes.Load() >= 2*snapshotBytes+CompactBytes
+}
+
+// Record keeps a plaintext tx batch that was appended to the log and applied
+// to the tree if a snapshot is being written
+// Batches that are recorded late and precede the last batch appended by the
+// compactor are appended again since they would be hidden by the snapshot.
+// Every batch recorded until they were appended is appended again after
+// them, so that the log replays in the order the batches were applied.
+func (c *Compactor) Record(record TxRecord) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.recording {
+		c.recorded = append(c.recorded, record)
+		return
+	}
+	if !c.appending && (c.last == "" || !txIDLess(record.ID, c.last)) {
+		return
+	}
+	c.late = append(c.late, record)
+	if !c.appending {
+		c.appending = true
+		go c.appendLate()
+	}
+}
+
+// appendLate appends the late tx batches until none are left
+func (c *Compactor) appendLate() {
+	defer func() {
+		c.lock.Lock()
+		c.late = nil
+		c.appending = false
+		c.lock.Unlock()
+	}()
+	// Only the holder of the lease may write after the pin
+	if err := c.fs.leaser.Acquire(false); err != nil {
+		zap.S().Warnw("failed to append tx batches that preceded compaction", "error", err)
+		return
+	}
+	defer c.fs.leaser.Release()
+
+	for {
+		c.appendLock.Lock()
+		c.lock.Lock()
+		records := c.late
+		c.late = nil
+		c.lock.Unlock()
+		if len(records) == 0 {
+			c.appendLock.Unlock()
+			return
+		}
+		var lines [][]byte
+		for _, record := range records {
+			lines = append(lines, txLines(record.Data)...)
+		}
+		zap.S().Debugw("appending tx batches that preceded compaction", "batches", len(records))
+		_, ids, err := appendTxLines(c.backend, c.fs.volume, lines, false)
+		if err == nil {
+			c.applied(ids)
+			c.lock.Lock()
+			c.last = ids[len(ids)-1]
+			c.lock.Unlock()
+		}
+		c.appendLock.Unlock()
+		if err != nil {
+			zap.S().Warnw("failed to append tx batches that preceded compaction", "error", err)
+			return
+		}
+	}
+}
+
+// take returns the recorded tx batches in log order and clears them
+// Recording stops if no batch precedes last, the last appended batch.
+func (c *Compactor) take(last string) ([]TxRecord, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	records := c.recorded
+	c.recorded = nil
+	sort.SliceStable(records, func(i, j int) bool {
+		return txIDLess(records[i].ID, records[j].ID)
+	})
+	if len(records) == 0 || !txIDLess(records[0].ID, last) {
+		c.recording = false
+		c.last = last
+		return nil, false
+	}
+	return records, true
+}
+
+// Compact writes a snapshot of the tree to the log and pins it
+func (c *Compactor) Compact() error {
+	c.lock.Lock()
+	if c.running {
+		c.lock.Unlock()
+		return errors.New("compaction is already running")
+	}
+	c.running = true
+	c.lock.Unlock()
+	defer func() {
+		c.lock.Lock()
+		c.running = false
+		c.recording = false
+		c.recorded = nil
+		c.lock.Unlock()
+	}()
+
+	// Only the holder of the lease may move the pin
+	fs := c.fs
+	if err := fs.leaser.Acquire(false); err != nil {
+		return err
+	}
+	defer fs.leaser.Release()
+
+	// Batches are recorded from the moment the snapshot is taken, so every
+	// change is either in the snapshot or recorded. Late batches that were
+	// not appended yet are in the snapshot too.
+	c.appendLock.Lock()
+	defer c.appendLock.Unlock()
+	fs.lock.Lock()
+	txs := fs.treeTxs()
+	c.lock.Lock()
+	c.recording = true
+	c.late = nil
+	c.lock.Unlock()
+	fs.lock.Unlock()
+
+	zap.S().Infow("compacting TXs online", "txs", fs.volume.logTxs.Load(), "paths", len(txs))
+	lines := encodeTxLines(txs)
+	size := int64(0)
+	for _, line := range lines {
+		size += int64(len(line)) + 1
+	}
+	firstID, ids, err := appendTxLines(c.backend, fs.volume, lines, true)
+	if err != nil {
+		return err
+	}
+	c.applied(ids)
+	count := int64(len(lines))
+
+	// Batches that were appended before the snapshot are appended again
+	// together with every batch recorded after them, in log order, until
+	// no batch precedes the last appended one
+	last := ids[len(ids)-1]
+	for {
+		records, ok := c.take(last)
+		if !ok {
+			break
+		}
+		var replay [][]byte
+		for _, record := range records {
+			for _, line := range txLines(record.Data) {
+				replay = append(replay, line)
+				size += int64(len(line)) + 1
+			}
+		}
+		zap.S().Debugw("appending txs applied during compaction", "batches", len(records))
+		_, replayIDs, err := appendTxLines(c.backend, fs.volume, replay, false)
+		if err != nil {
+			return err
+		}
+		c.applied(replayIDs)
+		count += int64(len(replay))
+		last = replayIDs[len(replayIDs)-1]
+	}
+
+	if !fs.leaser.Held() {
+		return errors.New("lost volume lease before moving the pin")
+	}
+	if err := c.backend.PinCheckpoint(firstID); err != nil {
+		return err
+	}
+
+	// Paths that did not change since the snapshot now live in it
+	fs.lock.Lock()
+	for i, tx := range txs {
+		if current, ok := fs.db.Get(tx.Path); ok && current == tx {
+			fs.db.SetMessage(tx.Path, ids[i])
+		}
+	}
+	fs.lock.Unlock()
+	fs.volume.logTxs.Store(count)
+	fs.volume.logBytes.Store(size)
+	c.lock.Lock()
+	c.snapshotBytes = size
+	c.lock.Unlock()
+	zap.S().Infow("online compaction done", "txs", count, "bytes", size)
+	return nil
+}
+
+// applied records the tx batches appended by the compactor as applied since
+// the tree already holds them
+func (c *Compactor) applied(ids []string) {
+	c.fs.lock.Lock()
+	for _, id := range ids {
+		c.fs.volume.applied(id)
+	}
+	c.fs.lock.Unlock()
+}
+
+// treeTxs returns the txs of the tree sorted so that the root folder tx
+// starts the log
+// fs.lock must be held.
+func (fs *Dsfs) treeTxs() []*Tx {
+	var txs []*Tx
+	it := fs.db.Iterator("/")
+	for _, tx, ok := it.Next(); ok; _, tx, ok = it.Next() {
+		txs = append(txs, tx)
+	}
+	sort.Slice(txs, func(i, j int) bool { return txs[i].Path < txs[j].Path })
+	return txs
+}
+
+// encodeTxLines encodes txs into tx lines
+func encodeTxLines(txs []*Tx) [][]byte {
+	lines := make([][]byte, len(txs))
+	for i, tx := range txs {
+		lines[i] = encodeTx(*tx)
+	}
+	return lines
+}
+
+// txLines splits a plaintext tx batch into tx lines
+func txLines(data []byte) [][]byte {
+	var lines [][]byte
+	for _, line := range bytes.Split(data, []byte{'\n'}) {
+		if len(line) != 0 {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// txIDLess reports whether the tx batch with ID a was appended before b
+// Backends use numeric IDs that increase as batches are appended.
+func txIDLess(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
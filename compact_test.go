@@ -0,0 +1,160 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// interleavingBackend runs hook before its first tx batch is appended
+type interleavingBackend struct {
+	Backend
+	hook func()
+}
+
+func (b *interleavingBackend) AppendTxs(batches [][]byte) ([]string, error) {
+	if hook := b.hook; hook != nil {
+		b.hook = nil
+		hook()
+	}
+	return b.Backend.AppendTxs(batches)
+}
+
+func TestOnlineCompaction(t *testing.T) {
+	backend := newTestLocalBackend(t, t.TempDir())
+	if _, err := setupDB(backend, NewVolume("", false), false, "map"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		for _, tx := range []Tx{
+			{Tx: WriteTx, Path: "/a", Type: FolderType},
+			createDeleteTx("/a"),
+		} {
+			if _, err := backend.AppendTxs([][]byte{encodeTx(tx)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if _, err := backend.AppendTxs([][]byte{encodeTx(Tx{Tx: WriteTx, Path: "/b", Type: FolderType})}); err != nil {
+		t.Fatal(err)
+	}
+	// A batch of a remote client that is only received after compaction
+	late := encodeTx(Tx{Tx: WriteTx, Path: "/late", Type: FolderType})
+	lateIDs, err := backend.AppendTxs([][]byte{late})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := backend.ListTxs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs := newTestDsfs(t, backend)
+	fs.lock.Lock()
+	fs.db.Delete("/late")
+	fs.lock.Unlock()
+	if got := fs.volume.logTxs.Load(); got != int64(len(before)) {
+		t.Errorf("got %d txs in the log, want %d", got, len(before))
+	}
+
+	// A remote client appends a batch while the snapshot is written
+	remote := &interleavingBackend{Backend: backend}
+	remote.hook = func() {
+		data := encodeTx(Tx{Tx: WriteTx, Path: "/remote", Type: FolderType})
+		ids, err := backend.AppendTxs([][]byte{data})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		tx, _ := decodeTx(data)
+		fs.lock.Lock()
+		fs.db.Insert(tx.Path, tx)
+		fs.lock.Unlock()
+		fs.compactor.Record(TxRecord{ID: ids[0], Data: data})
+	}
+	fs.compactor = NewCompactor(fs, remote)
+	if err := fs.compactor.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	fs.compactor.Record(TxRecord{ID: lateIDs[0], Data: late})
+
+	want := map[string]bool{"/": true, "/a": false, "/b": true, "/remote": true, "/late": true}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		records, err := backend.ListTxs()
+		if err != nil {
+			t.Fatal(err)
+		}
+		db := GetNewDB("map")
+		if err := applyMessageTxs(db, NewVolume("", false), records, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		missing := ""
+		for path, exists := range want {
+			if _, ok := db.Get(path); ok != exists {
+				missing = path
+			}
+		}
+		if missing == "" {
+			if len(records) >= len(before) {
+				t.Errorf("got %d records after compaction, want fewer than %d", len(records), len(before))
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("path %s exists = %v after compaction", missing, !want[missing])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// The late batch was counted when it was first applied
+	if got := fs.volume.logTxs.Load(); got != 3 {
+		t.Errorf("got %d txs in the log after compaction, want 3", got)
+	}
+}
+
+func TestCompactionLateOrder(t *testing.T) {
+	backend := newTestLocalBackend(t, t.TempDir())
+	if _, err := setupDB(backend, NewVolume("", false), false, "map"); err != nil {
+		t.Fatal(err)
+	}
+	// A remote batch that creates /x is only received after compaction
+	late := encodeTx(Tx{Tx: WriteTx, Path: "/x", Type: FolderType})
+	lateIDs, err := backend.AppendTxs([][]byte{late})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := newTestDsfs(t, backend)
+	fs.lock.Lock()
+	fs.db.Delete("/x")
+	fs.lock.Unlock()
+	fs.compactor = NewCompactor(fs, backend)
+	if err := fs.compactor.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The batch that deletes /x again is applied after the late one and has
+	// to be replayed after it too
+	fs.compactor.Record(TxRecord{ID: lateIDs[0], Data: late})
+	deleted := encodeTx(createDeleteTx("/x"))
+	ids, err := backend.AppendTxs([][]byte{deleted})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.compactor.Record(TxRecord{ID: ids[0], Data: deleted})
+
+	waitFor(t, "late batches to be appended", func() bool {
+		fs.compactor.lock.Lock()
+		defer fs.compactor.lock.Unlock()
+		return !fs.compactor.appending
+	})
+	records, err := backend.ListTxs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := GetNewDB("map")
+	if err := applyMessageTxs(db, NewVolume("", false), records, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := db.Get("/x"); ok {
+		t.Error("/x exists after replaying the late batches")
+	}
+}
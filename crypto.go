@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Argon2id parameters used for new volumes
+const (
+	KeyDerivationTime    = 3
+	KeyDerivationMemory  = 64 * 1024
+	KeyDerivationThreads = 4
+	KeySaltSize          = 16
+)
+
+// KeyParams stores the key derivation parameters of an encrypted volume
+type KeyParams struct {
+	KDF     string `json:"kdf"`
+	Salt    []byte `json:"salt"`
+	Time    uint32 `json:"t"`
+	Memory  uint32 `json:"m"`
+	Threads uint8  `json:"p"`
+	Check   string `json:"check"`
+	// Txs is set if tx batches are encrypted as well
+	Txs bool `json:"txs,omitempty"`
+}
+
+// newKeyParams generates key derivation parameters for a new volume
+func newKeyParams(passphrase string) (*KeyParams, error) {
+	params := &KeyParams{
+		KDF:     "argon2id",
+		Salt:    make([]byte, KeySaltSize),
+		Time:    KeyDerivationTime,
+		Memory:  KeyDerivationMemory,
+		Threads: KeyDerivationThreads,
+	}
+	if _, err := rand.Read(params.Salt); err != nil {
+		return nil, err
+	}
+	params.Check = keyCheck(params.derive(passphrase))
+	return params, nil
+}
+
+// derive derives the volume key from passphrase
+func (params *KeyParams) derive(passphrase string) []byte {
+	return argon2.IDKey([]byte(passphrase), params.Salt, params.Time, params.Memory, params.Threads, chacha20poly1305.KeySize)
+}
+
+// keyCheck computes a value that identifies a key without revealing it
+func keyCheck(key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("dsfs key check"))
+	return base64.URLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Key derives the volume key from passphrase and verifies it
+func (params *KeyParams) Key(passphrase string) ([]byte, error) {
+	if params.KDF != "argon2id" {
+		return nil, fmt.Errorf("unsupported key derivation function %q", params.KDF)
+	}
+	key := params.derive(passphrase)
+	if !hmac.Equal([]byte(keyCheck(key)), []byte(params.Check)) {
+		return nil, errors.New("wrong passphrase")
+	}
+	return key, nil
+}
+
+// Sealer encrypts and authenticates data with the volume key
+type Sealer struct {
+	aead cipher.AEAD
+}
+
+// NewSealer creates a new Sealer using XChaCha20-Poly1305
+func NewSealer(key []byte) (*Sealer, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	return &Sealer{aead: aead}, nil
+}
+
+// Overhead is the number of bytes added by Seal
+func (s *Sealer) Overhead() int {
+	return s.aead.NonceSize() + s.aead.Overhead()
+}
+
+// Seal encrypts data and prepends a random nonce
+func (s *Sealer) Seal(data []byte) ([]byte, error) {
+	nonce := make([]byte, s.aead.NonceSize(), s.aead.NonceSize()+len(data)+s.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return s.aead.Seal(nonce, nonce, data, nil), nil
+}
+
+// Open decrypts data produced by Seal
+func (s *Sealer) Open(data []byte) ([]byte, error) {
+	if len(data) < s.Overhead() {
+		return nil, errors.New("sealed data is too short")
+	}
+	nonce, ciphertext := data[:s.aead.NonceSize()], data[s.aead.NonceSize():]
+	return s.aead.Open(nil, nonce, ciphertext, nil)
+}
+
+// SealedBackend wraps a Backend and encrypts every data block and, if the
+// volume encrypts transactions, every tx batch
+type SealedBackend struct {
+	Backend
+	volume *Volume
+}
+
+// PutBlobs encrypts data blocks before storing them
+func (b *SealedBackend) PutBlobs(blobs [][]byte) ([]BlobRef, error) {
+	sealed := make([][]byte, len(blobs))
+	for i, blob := range blobs {
+		var err error
+		sealed[i], err = b.volume.sealer.Seal(blob)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b.Backend.PutBlobs(sealed)
+}
+
+// GetBlob decrypts a data block and writes to buffer
+func (b *SealedBackend) GetBlob(ref BlobRef, buffer []byte) (int, error) {
+	sealed := make([]byte, len(buffer)+b.volume.sealer.Overhead())
+	n, err := b.Backend.GetBlob(ref, sealed)
+	if err != nil {
+		return 0, err
+	}
+	data, err := b.volume.sealer.Open(sealed[:n])
+	if err != nil {
+		return 0, fmt.Errorf("failed to decrypt block %s, %w", ref.ID, err)
+	}
+	return copy(buffer, data), nil
+}
+
+// AppendTxs encrypts tx batches before appending them
+// Batches are read back with Volume.OpenTxs when the log is replayed.
+func (b *SealedBackend) AppendTxs(batches [][]byte) ([]string, error) {
+	sealed := make([][]byte, len(batches))
+	for i, batch := range batches {
+		var err error
+		sealed[i], err = b.volume.SealTxs(batch)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b.Backend.AppendTxs(sealed)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSealedBackend(t *testing.T) {
+	dir := t.TempDir()
+	backend, err := NewLocalBackend(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	volume := NewVolume("hunter2", false)
+	if _, err := setupDB(backend, volume, false, "map"); err != nil {
+		t.Fatal(err)
+	}
+	sealed := volume.Wrap(backend)
+
+	block := bytes.Repeat([]byte("secret"), 100)
+	refs, err := sealed.PutBlobs([][]byte{block})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := os.ReadFile(filepath.Join(dir, DataChannelName, refs[0].ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(stored, []byte("secret")) {
+		t.Error("block is stored in plaintext")
+	}
+	buffer := make([]byte, len(block))
+	n, err := sealed.GetBlob(refs[0], buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buffer[:n], block) {
+		t.Error("decrypted block does not match")
+	}
+
+	// Other clients read the key parameters from the root tx
+	for passphrase, ok := range map[string]bool{"hunter2": true, "wrong": false, "": false} {
+		_, err := setupDB(backend, NewVolume(passphrase, false), false, "radix")
+		if (err == nil) != ok {
+			t.Errorf("passphrase %q, got error %v", passphrase, err)
+		}
+	}
+
+	// Tampered blocks fail authentication
+	stored[len(stored)-1] ^= 1
+	if err := os.WriteFile(filepath.Join(dir, DataChannelName, refs[0].ID), stored, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sealed.GetBlob(refs[0], buffer); err == nil {
+		t.Error("expected tampered block to fail decryption")
+	}
+}
+
+func TestSealedTxs(t *testing.T) {
+	dir := t.TempDir()
+	backend, err := NewLocalBackend(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	volume := NewVolume("hunter2", true)
+	if _, err := setupDB(backend, volume, false, "map"); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := json.Marshal(&Tx{Tx: WriteTx, Path: "/secret-folder", Type: FolderType})
+	if _, err := volume.Wrap(backend).AppendTxs([][]byte{b}); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, _ := os.ReadDir(filepath.Join(dir, TxChannelName))
+	for _, entry := range entries {
+		data, _ := os.ReadFile(filepath.Join(dir, TxChannelName, entry.Name()))
+		if bytes.Contains(data, []byte("secret-folder")) {
+			t.Error("tx is stored in plaintext")
+		}
+	}
+
+	// Compaction keeps the log encrypted
+	volume = NewVolume("hunter2", false)
+	if _, err := setupDB(backend, volume, true, "radix"); err != nil {
+		t.Fatal(err)
+	}
+	db, err := setupDB(backend, NewVolume("hunter2", false), false, "radix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := db.Get("/secret-folder"); !ok {
+		t.Error("encrypted tx was not applied")
+	}
+
+	// Plaintext txs in an encrypted log are rejected
+	if _, err := backend.AppendTxs([][]byte{b}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := setupDB(backend, NewVolume("hunter2", false), false, "radix"); err == nil {
+		t.Error("expected mixed tx log to be rejected")
+	}
+}
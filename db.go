@@ -2,11 +2,10 @@ package main
 
 import (
 	"bytes"
-	"errors"
+	"fmt"
 	"io"
 	"strings"
 
-	"github.com/bwmarrin/discordgo"
 	"github.com/hashicorp/go-immutable-radix/v2"
 	"go.uber.org/zap"
 )
@@ -17,6 +16,25 @@ type DB interface {
 	Insert(key string, value *Tx)
 	Delete(key string)
 	Iterator(prefix string) Iterator
+	// SetMessage records the ID of the tx message holding the tx of key
+	SetMessage(key string, id string)
+	// Message returns the ID of the tx message holding the tx of key
+	Message(key string) (string, bool)
+}
+
+// txMessages maps keys to the tx messages holding their txs
+// Inserting or deleting a key forgets its message until it is set again.
+type txMessages map[string]string
+
+// SetMessage records the ID of the tx message holding the tx of key
+func (m txMessages) SetMessage(key string, id string) {
+	m[key] = id
+}
+
+// Message returns the ID of the tx message holding the tx of key
+func (m txMessages) Message(key string) (string, bool) {
+	id, ok := m[key]
+	return id, ok
 }
 
 // Iterator provides a consistent interface for implementing an iterator for DB
@@ -26,12 +44,13 @@ type Iterator interface {
 
 // RadixDB implements DB backed by a radix tree
 type RadixDB struct {
+	txMessages
 	radix *iradix.Tree[*Tx]
 }
 
 // NewRadixDB creates a new RadixDB
 func NewRadixDB() *RadixDB {
-	return &RadixDB{radix: iradix.New[*Tx]()}
+	return &RadixDB{txMessages: make(txMessages), radix: iradix.New[*Tx]()}
 }
 
 // Get is used to lookup a specific key, returning the value and if it was found
@@ -42,11 +61,13 @@ func (db *RadixDB) Get(key string) (*Tx, bool) {
 // Insert is used to add or update a given key
 func (db *RadixDB) Insert(key string, value *Tx) {
 	db.radix, _, _ = db.radix.Insert([]byte(key), value)
+	delete(db.txMessages, key)
 }
 
 // Delete is used to delete a given key
 func (db *RadixDB) Delete(key string) {
 	db.radix, _, _ = db.radix.Delete([]byte(key))
+	delete(db.txMessages, key)
 }
 
 // Iterator returns an Iterator that filters by prefix
@@ -69,12 +90,13 @@ func (iter *RadixDBIterator) Next() (string, *Tx, bool) {
 
 // MapDB implements DB backed by a map
 type MapDB struct {
+	txMessages
 	mapDB map[string]*Tx
 }
 
 // NewMapDB creates a new MapDB
 func NewMapDB() *MapDB {
-	return &MapDB{mapDB: make(map[string]*Tx)}
+	return &MapDB{txMessages: make(txMessages), mapDB: make(map[string]*Tx)}
 }
 
 // Get is used to lookup a specific key, returning the value and if it was found
@@ -86,11 +108,13 @@ func (db *MapDB) Get(key string) (*Tx, bool) {
 // Insert is used to add or update a given key
 func (db *MapDB) Insert(key string, value *Tx) {
 	db.mapDB[key] = value
+	delete(db.txMessages, key)
 }
 
 // Delete is used to delete a given key
 func (db *MapDB) Delete(key string) {
 	delete(db.mapDB, key)
+	delete(db.txMessages, key)
 }
 
 // MapIteratorEntry is used to return the next iteration for MapDBIterator
@@ -136,115 +160,56 @@ func GetNewDB(dbType string) DB {
 	}
 }
 
-// prepareChannels prepares the tx and data channels
-// creating channels if necessary
-func prepareChannels(dg *discordgo.Session, guildID string) (*discordgo.Channel, *discordgo.Channel, error) {
-	channels, err := dg.GuildChannels(guildID)
-	if err != nil {
-		return nil, nil, err
-	}
+// setupDB setups the in-mem database and unlocks the volume
+func setupDB(backend Backend, volume *Volume, compact bool, dbType string) (DB, error) {
+	db := GetNewDB(dbType)
 
-	// Find existing channels
-	channelMap := map[string]*discordgo.Channel{
-		DataChannelName: nil,
-		TxChannelName:   nil,
-	}
-	for _, channel := range channels {
-		if _, ok := channelMap[channel.Name]; ok {
-			channelMap[channel.Name] = channel
-		}
-	}
+	txBuffer := &bytes.Buffer{}
 
-	// Create missing channels
-	for name, channel := range channelMap {
-		if channel == nil {
-			create, err := dg.GuildChannelCreate(guildID, name, discordgo.ChannelTypeGuildText)
-			if err != nil {
-				return nil, nil, err
-			}
-			channelMap[name] = create
-		}
+	records, err := backend.ListTxs()
+	if err != nil {
+		return nil, err
 	}
 
-	return channelMap[TxChannelName], channelMap[DataChannelName], nil
-}
-
-// setupDB setups the in-mem database
-// This function needs to be refactored; it looks really gross in its current
-// state.
-func setupDB(dg *discordgo.Session, txChannel *discordgo.Channel, compact bool, dbType string) (DB, error) {
-	db := GetNewDB(dbType)
-
-	txBuffer := &bytes.Buffer{}
-	var pinnedMsg *discordgo.Message
-
-	// We check for the lastPinTimestamp to see which TX to start from
-	// this is not necessary, but if we need to speed up DB setup we can
-	// compress multiple TXs into one message and re-pin to the new starting
-	// TX.
-	//
-	// If lastPinTimestamp is not found, we insert the root folder to
-	// initialize.
-	if txChannel.LastPinTimestamp != nil {
-		pinnedMsgs, err := dg.ChannelMessagesPinned(txChannel.ID)
+	// If no checkpoint is found, we insert the root folder to initialize.
+	// The root folder tx is never encrypted since it holds the settings
+	// needed to unlock the volume.
+	if len(records) != 0 {
+		root, err := readRoot(records)
 		if err != nil {
 			return nil, err
 		}
-		if len(pinnedMsgs) == 0 {
-			return nil, errors.New("pin timestamp found but no pins were found, very weird")
-		}
-
-		// Get the latest pinned message
-		pinnedMsg = pinnedMsgs[len(pinnedMsgs)-1]
-		messages := []*discordgo.Message{pinnedMsg}
-		for {
-			batch, err := dg.ChannelMessages(
-				txChannel.ID,
-				MaxDiscordMessageRequest,
-				"", messages[len(messages)-1].ID, "",
-			)
-			if err != nil {
-				return nil, err
-			}
-			if len(batch) == 0 {
-				break
-			}
-
-			// Messages are in reverse order
-			for i, j := 0, len(batch)-1; i < j; i, j = i+1, j-1 {
-				batch[i], batch[j] = batch[j], batch[i]
-			}
-			messages = append(messages, batch...)
-
-			if len(batch) != MaxDiscordMessageRequest {
-				break
-			}
+		err = volume.Unlock(root)
+		if err != nil {
+			return nil, err
 		}
-
 		if compact {
 			zap.S().Info("compacting TXs")
-			applyMessageTxs(db, messages, txBuffer, false)
+			err = applyMessageTxs(db, volume, records, txBuffer, nil)
 		} else {
-			applyMessageTxs(db, messages, nil, false)
+			err = applyMessageTxs(db, volume, records, nil, nil)
+		}
+		if err != nil {
+			return nil, err
 		}
 	} else {
-		tx := &Tx{
-			Tx:   WriteTx,
-			Path: "/",
-			Type: FolderType,
+		tx, err := volume.NewRoot()
+		if err != nil {
+			return nil, err
+		}
+		err = volume.Unlock(tx)
+		if err != nil {
+			return nil, err
 		}
 		db.Insert("/", tx)
-		b, _ := json.Marshal(tx)
-		var err error
-		pinnedMsg, err = dg.ChannelFileSend(
-			txChannel.ID,
-			TxChannelName,
-			bytes.NewReader(b),
-		)
+		ids, err := backend.AppendTxs([][]byte{volume.Header()})
 		if err != nil {
 			return nil, err
 		}
-		err = dg.ChannelMessagePin(txChannel.ID, pinnedMsg.ID)
+		db.SetMessage("/", ids[0])
+		volume.countTxs(volume.Header())
+		volume.lastTx = ids[0]
+		err = backend.PinCheckpoint(ids[0])
 		if err != nil {
 			return nil, err
 		}
@@ -256,60 +221,118 @@ func setupDB(dg *discordgo.Session, txChannel *discordgo.Channel, compact bool,
 		return db, nil
 	}
 
-	messageBuffer := make([]byte, 0, MaxDiscordFileSize)
-	var firstMsg *discordgo.Message
+	var lines [][]byte
 	for {
 		b, err := txBuffer.ReadBytes('\n')
 		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
 			zap.S().Warnw("failed to read message buffer", "error", err)
 			return db, nil
 		}
-		if err != nil || len(b) == 0 {
-			break
+		if len(b) != 0 {
+			lines = append(lines, bytes.TrimSuffix(b, []byte{'\n'}))
 		}
-
-		// If message buffer overflows, flush the data
-		if len(messageBuffer)+len(b) > MaxDiscordFileSize {
-			msg, err := dg.ChannelFileSend(txChannel.ID, TxChannelName, bytes.NewReader(messageBuffer))
-			if err != nil {
-				zap.S().Warnw("aborting transaction compaction", "error", err)
-				return db, nil
-			}
-			if firstMsg == nil {
-				firstMsg = msg
-			}
-			// Keep underlying allocated memory
-			messageBuffer = messageBuffer[:0]
-		} else {
-			messageBuffer = append(messageBuffer, b...)
+		if err != nil {
+			break
 		}
 	}
+	ids, err := compactTxs(backend, volume, lines)
+	if err != nil {
+		zap.S().Warnw("aborting transaction compaction", "error", err)
+		return db, nil
+	}
 
-	// Check if messageBuffer has outstanding transactions
-	if len(messageBuffer) != 0 {
-		msg, err := dg.ChannelFileSend(txChannel.ID, TxChannelName, bytes.NewReader(messageBuffer))
-		if err != nil {
-			zap.S().Warnw("aborting transaction compaction", "error", err)
-			return db, nil
+	// Txs now live in the compacted messages
+	if len(ids) != 0 {
+		volume.lastTx = ids[len(ids)-1]
+	}
+	volume.logTxs.Store(0)
+	volume.logBytes.Store(0)
+	messages := make(map[string]string)
+	for i, line := range lines {
+		volume.countTxs(line)
+		var tx Tx
+		if json.Unmarshal(line, &tx) == nil && tx.Tx == WriteTx {
+			messages[tx.Path] = ids[i]
 		}
-		if firstMsg == nil {
-			firstMsg = msg
+	}
+	for path, id := range messages {
+		if _, ok := db.Get(path); ok {
+			db.SetMessage(path, id)
 		}
 	}
 
+	return db, nil
+}
+
+// compactTxs appends tx lines in as few batches as possible and pins the
+// first batch as the new start of the log
+// The ID of the batch holding every line is returned.
+func compactTxs(backend Backend, volume *Volume, lines [][]byte) ([]string, error) {
+	firstID, ids, err := appendTxLines(backend, volume, lines, true)
+	if err != nil {
+		return nil, err
+	}
+
 	// Pin new start point
-	if firstMsg != nil {
-		err := dg.ChannelMessagePin(txChannel.ID, firstMsg.ID)
+	if firstID != "" {
+		if err := backend.PinCheckpoint(firstID); err != nil {
+			return nil, fmt.Errorf("failed to pin new transaction start point, %w", err)
+		}
+	}
+	return ids, nil
+}
+
+// appendTxLines appends tx lines in as few batches as possible
+// If header is set, encrypted tx logs get a volume header first. The ID of
+// the first appended batch and of the batch holding every line are returned.
+func appendTxLines(backend Backend, volume *Volume, lines [][]byte, header bool) (string, []string, error) {
+	// Encrypted tx logs start with the plaintext volume header
+	var firstID string
+	if header && volume.SealsTxs() {
+		ids, err := backend.AppendTxs([][]byte{volume.Header()})
 		if err != nil {
-			zap.S().Warn("failed to pin new transaction start point")
-			return db, nil
+			return "", nil, err
 		}
-		err = dg.ChannelMessageUnpin(txChannel.ID, pinnedMsg.ID)
+		firstID = ids[0]
+	}
+
+	sealedBackend := volume.Wrap(backend)
+	maxSize := MaxDiscordFileSize - volume.TxOverhead()
+	messageBuffer := make([]byte, 0, maxSize)
+	ids := make([]string, len(lines))
+	first := 0
+	flush := func(end int) error {
+		batch, err := sealedBackend.AppendTxs([][]byte{messageBuffer})
 		if err != nil {
-			zap.S().Warn("failed to unpin old transaction start point, please manually unpin old pinned messages")
-			return db, nil
+			return err
+		}
+		if firstID == "" {
+			firstID = batch[0]
+		}
+		for i := first; i < end; i++ {
+			ids[i] = batch[0]
 		}
+		first = end
+		// Keep underlying allocated memory
+		messageBuffer = messageBuffer[:0]
+		return nil
 	}
 
-	return db, nil
+	for i, line := range lines {
+		// If message buffer overflows, flush the data
+		if len(messageBuffer) != 0 && len(messageBuffer)+len(line)+1 > maxSize {
+			if err := flush(i); err != nil {
+				return "", nil, err
+			}
+		}
+		messageBuffer = append(append(messageBuffer, line...), '\n')
+	}
+
+	// Check if messageBuffer has outstanding transactions
+	if len(messageBuffer) != 0 {
+		if err := flush(len(lines)); err != nil {
+			return "", nil, err
+		}
+	}
+	return firstID, ids, nil
 }
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestDBMessages(t *testing.T) {
+	for _, dbType := range []string{"radix", "map"} {
+		db := GetNewDB(dbType)
+		db.Insert("/a", &Tx{Tx: WriteTx, Path: "/a"})
+		db.SetMessage("/a", "1")
+		db.Insert("/b", &Tx{Tx: WriteTx, Path: "/b"})
+		db.SetMessage("/b", "1")
+		if id, ok := db.Message("/a"); !ok || id != "1" {
+			t.Errorf("%s: got message %q, want %q", dbType, id, "1")
+		}
+
+		// Replaced and deleted txs forget their message
+		db.Insert("/a", &Tx{Tx: WriteTx, Path: "/a"})
+		if _, ok := db.Message("/a"); ok {
+			t.Errorf("%s: replaced tx kept its message", dbType)
+		}
+		db.SetMessage("/a", "2")
+		db.Delete("/b")
+		if _, ok := db.Message("/b"); ok {
+			t.Errorf("%s: deleted tx kept its message", dbType)
+		}
+		if id, ok := db.Message("/a"); !ok || id != "2" {
+			t.Errorf("%s: got message %q, want %q", dbType, id, "2")
+		}
+	}
+}
+
+func TestSetupDBMessages(t *testing.T) {
+	backend, err := NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := setupDB(backend, NewVolume("", false), false, "map"); err != nil {
+		t.Fatal(err)
+	}
+	var batches [][]byte
+	for _, tx := range []Tx{
+		{Tx: WriteTx, Path: "/a", Type: FolderType},
+		{Tx: WriteTx, Path: "/b", Type: FolderType},
+		createDeleteTx("/b"),
+	} {
+		b, _ := json.Marshal(tx)
+		batches = append(batches, b)
+	}
+	ids, err := backend.AppendTxs(batches)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := setupDB(backend, NewVolume("", false), false, "radix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, ok := db.Message("/a"); !ok || id != ids[0] {
+		t.Errorf("got message %q, want %q", id, ids[0])
+	}
+	if _, ok := db.Message("/b"); ok {
+		t.Error("deleted path kept its message")
+	}
+
+	// Compaction moves every tx to the compacted messages
+	db, err = setupDB(backend, NewVolume("", false), true, "radix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := backend.ListTxs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/", "/a"} {
+		if id, ok := db.Message(path); !ok || id != records[0].ID {
+			t.Errorf("path %s is in message %q, want %q", path, id, records[0].ID)
+		}
+	}
+}
+
+func TestTxFormatVersion(t *testing.T) {
+	for name, c := range map[string]struct {
+		root, tx Tx
+		ok       bool
+	}{
+		"legacy":       {Tx{Tx: WriteTx, Path: "/", Type: FolderType}, Tx{Tx: WriteTx, Path: "/a"}, true},
+		"current":      {Tx{Tx: WriteTx, Path: "/", Type: FolderType, Version: TxFormatVersion}, Tx{Tx: WriteTx, Path: "/a"}, true},
+		"newer root":   {Tx{Tx: WriteTx, Path: "/", Type: FolderType, Version: TxFormatVersion + 1}, Tx{Tx: WriteTx, Path: "/a"}, false},
+		"newer tx":     {Tx{Tx: WriteTx, Path: "/", Type: FolderType}, Tx{Tx: WriteTx, Path: "/a", Version: TxFormatVersion + 1}, false},
+		"unknown type": {Tx{Tx: WriteTx, Path: "/", Type: FolderType}, Tx{Tx: DeleteTx + 1, Path: "/a"}, false},
+	} {
+		backend := newTestLocalBackend(t, t.TempDir())
+		root, _ := json.Marshal(c.root)
+		tx, _ := json.Marshal(c.tx)
+		ids, err := backend.AppendTxs([][]byte{root, tx})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := backend.PinCheckpoint(ids[0]); err != nil {
+			t.Fatal(err)
+		}
+		_, err = setupDB(backend, NewVolume("", false), false, "map")
+		if (err == nil) != c.ok {
+			t.Errorf("%s: got error %v", name, err)
+		}
+	}
+}
+
+func TestLongTxLine(t *testing.T) {
+	backend := newTestLocalBackend(t, t.TempDir())
+	volume := NewVolume("", false)
+	if _, err := setupDB(backend, volume, false, "map"); err != nil {
+		t.Fatal(err)
+	}
+	// Txs of large files are longer than the default line limit of a scanner
+	large := Tx{Tx: WriteTx, Path: "/large", Type: FileType}
+	for i := 0; i < 800; i++ {
+		large.FileIDs = append(large.FileIDs, fmt.Sprintf("%020d", i))
+		large.MessageIDs = append(large.MessageIDs, fmt.Sprintf("%020d", i))
+		large.Checksums = append(large.Checksums, blockChecksum([]byte{byte(i)}))
+		large.Lengths = append(large.Lengths, FileBlockSize)
+	}
+	line := encodeTx(large)
+	if len(line) <= bufio.MaxScanTokenSize {
+		t.Fatalf("tx line of %d bytes is not long enough", len(line))
+	}
+	batch := bytes.Join([][]byte{line, encodeTx(Tx{Tx: WriteTx, Path: "/after", Type: FolderType})}, []byte{'\n'})
+	ids, err := backend.AppendTxs([][]byte{batch})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if txs, _, err := readTxs(volume, TxRecord{ID: ids[0], Data: batch}); err != nil || len(txs) != 2 {
+		t.Fatalf("read %d txs, %v", len(txs), err)
+	}
+	db, err := setupDB(backend, NewVolume("", false), false, "map")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/large", "/after"} {
+		if _, ok := db.Get(path); !ok {
+			t.Errorf("%s was not replayed", path)
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	backend := newTestLocalBackend(t, t.TempDir())
+	root, _ := json.Marshal(Tx{Tx: WriteTx, Path: "/", Type: FolderType})
+	ids, err := backend.AppendTxs([][]byte{root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.PinCheckpoint(ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("hello")
+	putFile(t, backend, "/a", []byte("old"))
+	putFile(t, backend, "/a", data)
+
+	volume := NewVolume("", false)
+	db, err := setupDB(backend, volume, false, "map")
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrated := NewDsfs(backend, volume, db, nil, nil, "memory", RawCodec, nil)
+	migrated.leaser = NewLeaser(backend)
+	if code := runMigrate(migrated, backend); code != 0 {
+		t.Fatalf("migrate failed with %d", code)
+	}
+
+	// The log only holds the tree in the current format
+	records, err := backend.ListTxs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var txs []*Tx
+	for _, record := range records {
+		batch, _, err := readTxs(volume, record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		txs = append(txs, batch...)
+	}
+	if len(txs) != 2 || txs[0].Path != "/" {
+		t.Fatalf("expected the root and /a, got %d txs", len(txs))
+	}
+	for _, tx := range txs {
+		if tx.Version != TxFormatVersion {
+			t.Errorf("tx of %s has version %d", tx.Path, tx.Version)
+		}
+	}
+
+	fs := newTestDsfs(t, backend)
+	if v := fs.volume.Version(); v != TxFormatVersion {
+		t.Errorf("volume has version %d", v)
+	}
+	if got := readFile(t, fs, "/a", len(data)); !bytes.Equal(got, data) {
+		t.Errorf("got %q, want %q", got, data)
+	}
+	if code := runMigrate(fs, backend); code != 0 {
+		t.Fatalf("second migrate failed with %d", code)
+	}
+}
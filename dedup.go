@@ -0,0 +1,108 @@
+package main
+
+import "sync"
+
+// BlockRef locates a stored data block
+type BlockRef struct {
+	BlobRef
+	Codec Codec
+}
+
+// BlockIndex maps block checksums to stored blocks across the whole volume
+// Blocks are counted by the txs of the tree referencing them and dropped once
+// no tx does, so that blocks which may be garbage collected are never
+// reused. The same checksum may be stored in several blobs, which are counted
+// separately.
+type BlockIndex struct {
+	blocks map[string][]indexedBlock
+	lock   sync.RWMutex
+}
+
+// indexedBlock is a stored block and the number of txs referencing it
+type indexedBlock struct {
+	ref  BlockRef
+	refs int
+}
+
+// NewBlockIndex creates a new BlockIndex
+func NewBlockIndex() *BlockIndex {
+	return &BlockIndex{blocks: make(map[string][]indexedBlock)}
+}
+
+// Add indexes the blocks of tx
+func (i *BlockIndex) Add(tx *Tx) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	for idx, checksum := range tx.Checksums {
+		if idx >= len(tx.FileIDs) {
+			continue
+		}
+		ref := BlockRef{BlobRef: tx.BlockRef(idx), Codec: tx.Codec(idx)}
+		stored := i.blocks[checksum]
+		found := false
+		for j := range stored {
+			if stored[j].ref.ID == ref.ID {
+				stored[j].refs++
+				found = true
+				break
+			}
+		}
+		if !found {
+			i.blocks[checksum] = append(stored, indexedBlock{ref: ref, refs: 1})
+		}
+	}
+}
+
+// Remove drops the references of tx
+func (i *BlockIndex) Remove(tx *Tx) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	for idx, checksum := range tx.Checksums {
+		if idx >= len(tx.FileIDs) {
+			continue
+		}
+		stored := i.blocks[checksum]
+		for j := range stored {
+			if stored[j].ref.ID != tx.FileIDs[idx] {
+				continue
+			}
+			if stored[j].refs--; stored[j].refs <= 0 {
+				stored = append(stored[:j:j], stored[j+1:]...)
+			}
+			break
+		}
+		if len(stored) == 0 {
+			delete(i.blocks, checksum)
+		} else {
+			i.blocks[checksum] = stored
+		}
+	}
+}
+
+// Replace indexes tx in place of old, either of which may be nil
+func (i *BlockIndex) Replace(old, tx *Tx) {
+	if tx != nil {
+		i.Add(tx)
+	}
+	if old != nil {
+		i.Remove(old)
+	}
+}
+
+// Get looks up a stored block by checksum
+func (i *BlockIndex) Get(checksum string) (BlockRef, bool) {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+	stored := i.blocks[checksum]
+	if len(stored) == 0 {
+		return BlockRef{}, false
+	}
+	return stored[len(stored)-1].ref, true
+}
+
+// Len returns the number of indexed blocks
+func (i *BlockIndex) Len() int {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+	return len(i.blocks)
+}
@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestBlockIndex(t *testing.T) {
+	index := NewBlockIndex()
+	a := &Tx{Path: "/a", FileIDs: []string{"x"}, Checksums: []string{"sum"}}
+	b := &Tx{Path: "/b", FileIDs: []string{"y"}, Checksums: []string{"sum"}}
+	c := &Tx{Path: "/c", FileIDs: []string{"y"}, Checksums: []string{"sum"}}
+
+	// The same block stored twice is counted per blob
+	index.Add(a)
+	index.Add(b)
+	index.Add(c)
+	index.Remove(b)
+	if ref, ok := index.Get("sum"); !ok || ref.ID != "y" {
+		t.Fatalf("expected blob y while /c references it, got %v, %v", ref.ID, ok)
+	}
+	index.Remove(c)
+	if ref, ok := index.Get("sum"); !ok || ref.ID != "x" {
+		t.Fatalf("expected the surviving blob x, got %v, %v", ref.ID, ok)
+	}
+	index.Remove(a)
+	if _, ok := index.Get("sum"); ok || index.Len() != 0 {
+		t.Fatal("unreferenced block is still indexed")
+	}
+}
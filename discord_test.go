@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// newTestDiscordBackend connects a DiscordBackend to a FakeDiscord server
+func newTestDiscordBackend(t *testing.T, f *FakeDiscord) *DiscordBackend {
+	backend, err := NewDiscordBackend("token", false, f.guildID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { backend.dg.Close() })
+	return backend
+}
+
+// waitFor polls cond until it holds or the test times out
+func waitFor(t *testing.T, what string, cond func() bool) {
+	// Writes wait up to QueueTimeout for both the data and the tx queue
+	deadline := time.Now().Add(4 * QueueTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDiscordSetupDB(t *testing.T) {
+	f := newFakeDiscord(t)
+	backend := newTestDiscordBackend(t, f)
+
+	txChannelID := f.ChannelID(TxChannelName)
+	if txChannelID == "" || f.ChannelID(DataChannelName) == "" {
+		t.Fatal("channels were not created")
+	}
+
+	db, err := setupDB(backend, NewVolume("", false), false, "radix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := db.Get("/"); !ok {
+		t.Fatal("root folder was not initialized")
+	}
+	if n := len(f.Messages(txChannelID)); n != 1 {
+		t.Fatalf("expected root tx message, got %d messages", n)
+	}
+
+	// A second client sees the pinned root and existing channels
+	b, _ := json.Marshal(&Tx{Tx: WriteTx, Path: "/docs", Type: FolderType})
+	f.PostMessage(txChannelID, "2", []string{TxChannelName}, [][]byte{b})
+
+	db, err = setupDB(newTestDiscordBackend(t, f), NewVolume("", false), false, "map")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/", "/docs"} {
+		if _, ok := db.Get(path); !ok {
+			t.Errorf("path %s is missing", path)
+		}
+	}
+}
+
+func TestDiscordEndpoints(t *testing.T) {
+	f := newFakeDiscord(t)
+	backend, err := NewDiscordBackend("token", false, f.guildID, f.GatewayURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.dg.Close()
+	if f.gatewayLookups != 0 {
+		t.Errorf("gateway was looked up %d times despite being configured", f.gatewayLookups)
+	}
+
+	// Tx attachments are fetched from the configured CDN, not the message URL
+	b, _ := json.Marshal(&Tx{Tx: WriteTx, Path: "/docs", Type: FolderType})
+	m := f.PostMessage(f.ChannelID(TxChannelName), "2", []string{TxChannelName}, [][]byte{b})
+	m.Attachments[0].URL = "https://cdn.discordapp.com/attachments/invalid"
+	records, err := backend.messageRecords([]*discordgo.Message{m})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || !bytes.Equal(records[0].Data, b) {
+		t.Fatalf("got records %v, want tx batch from fake CDN", records)
+	}
+}
+
+func TestDiscordWriterBatching(t *testing.T) {
+	f := newFakeDiscord(t)
+	backend := newTestDiscordBackend(t, f)
+	writer := setupWriter(backend)
+
+	refs := make([]BlobRef, MaxDiscordFileCount)
+	var wg sync.WaitGroup
+	for i := range refs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ref, err := writer.SendData([]byte(fmt.Sprintf("block %d", i)))
+			if err != nil {
+				t.Error(err)
+			}
+			refs[i] = ref
+		}(i)
+	}
+	wg.Wait()
+
+	messages := f.Messages(f.ChannelID(DataChannelName))
+	if len(messages) != 1 || len(messages[0].Attachments) != MaxDiscordFileCount {
+		t.Fatalf("expected 1 message with %d attachments, got %d messages", MaxDiscordFileCount, len(messages))
+	}
+
+	buffer := make([]byte, 64)
+	for i, ref := range refs {
+		if ref.MessageID != messages[0].ID {
+			t.Errorf("block %d is in message %q, want %q", i, ref.MessageID, messages[0].ID)
+		}
+		n, err := backend.GetBlob(ref, buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("block %d", i); string(buffer[:n]) != want {
+			t.Errorf("got block %q, want %q", buffer[:n], want)
+		}
+	}
+}
+
+func TestDiscordCompaction(t *testing.T) {
+	f := newFakeDiscord(t)
+	backend := newTestDiscordBackend(t, f)
+	if _, err := setupDB(backend, NewVolume("", false), false, "radix"); err != nil {
+		t.Fatal(err)
+	}
+
+	txChannelID := f.ChannelID(TxChannelName)
+	for i := 0; i < 5; i++ {
+		b, _ := json.Marshal(&Tx{Tx: WriteTx, Path: fmt.Sprintf("/%d", i), Type: FolderType})
+		f.PostMessage(txChannelID, "2", []string{TxChannelName}, [][]byte{b})
+	}
+	b, _ := json.Marshal(createDeleteTx("/0"))
+	f.PostMessage(txChannelID, "2", []string{TxChannelName}, [][]byte{b})
+
+	backend = newTestDiscordBackend(t, f)
+	if _, err := setupDB(backend, NewVolume("", false), true, "radix"); err != nil {
+		t.Fatal(err)
+	}
+
+	messages := f.Messages(txChannelID)
+	last := messages[len(messages)-1]
+	pinned, err := backend.dg.ChannelMessagesPinned(txChannelID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pinned) != 1 || pinned[0].ID != last.ID {
+		t.Fatalf("expected compacted message %s to be the only pin, got %v", last.ID, pinned)
+	}
+
+	db, err := setupDB(newTestDiscordBackend(t, f), NewVolume("", false), false, "radix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]bool{"/": true, "/0": false, "/1": true, "/4": true} {
+		if _, ok := db.Get(path); ok != want {
+			t.Errorf("path %s exists = %v, want %v", path, ok, want)
+		}
+	}
+}
+
+func TestDiscordLiveTx(t *testing.T) {
+	f := newFakeDiscord(t)
+	backend := newTestDiscordBackend(t, f)
+	db, err := setupDB(backend, NewVolume("", false), false, "radix")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dsfs := NewDsfs(backend, NewVolume("", false), db, setupWriter(backend), NewScheduler(4), "memory", RawCodec, nil)
+	backend.SubscribeTxs(dsfs)
+	t.Cleanup(func() { backend.SubscribeTxs(nil) })
+
+	// Open a file so that the live tx patches its cached contents
+	content := []byte("hello world")
+	dataIDs := f.PostMessage(f.ChannelID(DataChannelName), "2", []string{DataChannelName}, [][]byte{content})
+	tx := &Tx{
+		Tx:      WriteTx,
+		Path:    "/file",
+		Type:    FileType,
+		FileIDs: []string{dataIDs.Attachments[0].ID},
+		Size:    int64(len(content)),
+	}
+	dsfs.db.Insert(tx.Path, tx)
+	if errc, _ := dsfs.Open(tx.Path, 0); errc != 0 {
+		t.Fatalf("open failed with %d", errc)
+	}
+
+	// Remote client overwrites the file and creates a folder
+	content = []byte("hello remote")
+	dataIDs = f.PostMessage(f.ChannelID(DataChannelName), "2", []string{DataChannelName}, [][]byte{content})
+	tx = &Tx{
+		Tx:        WriteTx,
+		Path:      "/file",
+		Type:      FileType,
+		FileIDs:   []string{dataIDs.Attachments[0].ID},
+		Checksums: []string{blockChecksum(content)},
+		Size:      int64(len(content)),
+	}
+	b1, _ := json.Marshal(tx)
+	b2, _ := json.Marshal(&Tx{Tx: WriteTx, Path: "/remote", Type: FolderType})
+	f.PostMessage(f.ChannelID(TxChannelName), "2", []string{TxChannelName}, [][]byte{append(append(b1, '\n'), b2...)})
+
+	waitFor(t, "remote folder", func() bool {
+		dsfs.lock.Lock()
+		defer dsfs.lock.Unlock()
+		_, ok := dsfs.db.Get("/remote")
+		return ok
+	})
+
+	buffer := make([]byte, len(content))
+	waitFor(t, "remote contents", func() bool {
+		n := dsfs.Read("/file", buffer, 0, 1)
+		return n == len(content) && bytes.Equal(buffer, content)
+	})
+}
+
+func TestDiscordSignedURLs(t *testing.T) {
+	f := newFakeDiscord(t)
+	f.SignURLs(time.Hour)
+	backend := newTestDiscordBackend(t, f)
+
+	refs, err := backend.PutBlobs([][]byte{[]byte("hello"), []byte("world")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(ref BlobRef, want string) {
+		t.Helper()
+		buffer := make([]byte, 16)
+		n, err := backend.GetBlob(ref, buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buffer[:n]) != want {
+			t.Errorf("got blob %q, want %q", buffer[:n], want)
+		}
+	}
+
+	// URLs returned by the upload are cached until they expire
+	get(refs[0], "hello")
+	if f.messageLookups != 0 || f.urlRefreshes != 0 {
+		t.Errorf("cached URL was refreshed, %d lookups and %d refreshes", f.messageLookups, f.urlRefreshes)
+	}
+
+	// Rejected URLs are refreshed through the message of the block, which
+	// also refreshes the other blocks of the message
+	f.RevokeURLs()
+	get(refs[0], "hello")
+	get(refs[1], "world")
+	if f.messageLookups != 1 {
+		t.Errorf("expected 1 message lookup, got %d", f.messageLookups)
+	}
+
+	// Blocks without a message ID use the refresh endpoint
+	f.RevokeURLs()
+	backend = newTestDiscordBackend(t, f)
+	get(BlobRef{ID: refs[1].ID}, "world")
+	if f.urlRefreshes != 1 {
+		t.Errorf("expected 1 URL refresh, got %d", f.urlRefreshes)
+	}
+}
+
+func TestDiscordMigrate(t *testing.T) {
+	f := newFakeDiscord(t)
+	f.SignURLs(time.Hour)
+	backend := newTestDiscordBackend(t, f)
+	volume := NewVolume("", false)
+	if _, err := setupDB(backend, volume, false, "radix"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Txs written by older versions only record attachment IDs
+	content := []byte("hello world")
+	m := f.PostMessage(f.ChannelID(DataChannelName), fakeBotID, []string{DataChannelName}, [][]byte{content})
+	b, _ := json.Marshal(&Tx{
+		Tx:        WriteTx,
+		Path:      "/file",
+		Type:      FileType,
+		FileIDs:   []string{m.Attachments[0].ID},
+		Checksums: []string{blockChecksum(content)},
+		Size:      int64(len(content)),
+	})
+	f.PostMessage(f.ChannelID(TxChannelName), "2", []string{TxChannelName}, [][]byte{b})
+
+	backend = newTestDiscordBackend(t, f)
+	db, err := setupDB(backend, volume, false, "radix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := NewDsfs(backend, volume, db, nil, nil, "memory", RawCodec, nil)
+	fs.leaser = NewLeaser(backend)
+	if code := runMigrate(fs, backend); code != 0 {
+		t.Fatalf("migrate failed with %d", code)
+	}
+
+	// The migrated tx is replayed by other clients
+	db, err = setupDB(newTestDiscordBackend(t, f), NewVolume("", false), false, "radix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, ok := db.Get("/file")
+	if !ok || len(tx.MessageIDs) != 1 || tx.MessageIDs[0] != m.ID {
+		t.Fatalf("got tx %+v, want message ID %s", tx, m.ID)
+	}
+	if code := runMigrate(fs, backend); code != 0 {
+		t.Fatalf("second migrate failed with %d", code)
+	}
+}
+
+func TestDiscordLease(t *testing.T) {
+	f := newFakeDiscord(t)
+	backend := newTestDiscordBackend(t, f)
+	a := NewLeaser(backend)
+	b := NewLeaser(newTestDiscordBackend(t, f))
+
+	if err := a.Acquire(true); err != nil {
+		t.Fatal(err)
+	}
+	renewLease(t, a, backend)
+	if err := b.Acquire(false); !errors.Is(err, ErrLeaseHeld) {
+		t.Fatalf("got error %v, want %v", err, ErrLeaseHeld)
+	}
+	if held, err := b.HeldByOther(); err != nil || !held {
+		t.Errorf("held by other = %v, %v, want true", held, err)
+	}
+	a.Release()
+	if err := b.Acquire(false); err != nil {
+		t.Fatal(err)
+	}
+	b.Release()
+
+	// Lease messages are not tx batches
+	db, err := setupDB(newTestDiscordBackend(t, f), NewVolume("", false), true, "map")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := db.Get("/"); !ok {
+		t.Fatal("root folder was not initialized")
+	}
+}
+
+func TestDiscordSnapshot(t *testing.T) {
+	f := newFakeDiscord(t)
+	path := filepath.Join(t.TempDir(), "volume.snapshot")
+	if _, err := loadDB(newTestDiscordBackend(t, f), NewVolume("", false), false, "radix", path); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"/a", "/b"} {
+		b, _ := json.Marshal(Tx{Tx: WriteTx, Path: p, Type: FolderType})
+		f.PostMessage(f.ChannelID(TxChannelName), "2", []string{TxChannelName}, [][]byte{b})
+	}
+
+	for i := 0; i < 2; i++ {
+		volume := NewVolume("", false)
+		db, err := loadDB(newTestDiscordBackend(t, f), volume, false, "radix", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range []string{"/", "/a", "/b"} {
+			if _, ok := db.Get(p); !ok {
+				t.Errorf("load %d, path %s is missing", i, p)
+			}
+		}
+		if last := f.Messages(f.ChannelID(TxChannelName)); volume.lastTx != last[len(last)-1].ID {
+			t.Errorf("load %d, last applied tx batch is %s", i, volume.lastTx)
+		}
+	}
+}
+
+func TestDiscordSnapshotCompaction(t *testing.T) {
+	f := newFakeDiscord(t)
+	backend := newTestDiscordBackend(t, f)
+	path := filepath.Join(t.TempDir(), "volume.snapshot")
+	volume := NewVolume("", false)
+	db, err := loadDB(backend, volume, false, "radix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := NewDsfs(backend, volume, db, setupWriter(backend), NewScheduler(4), "memory", RawCodec, nil)
+	fs.leaser = NewLeaser(backend)
+	fs.compactor = NewCompactor(fs, backend)
+	fs.snapshots = NewSnapshotter(fs, backend, path)
+	sent := fs.volume.logTxs.Load()
+	for _, p := range []string{"/a", "/b"} {
+		if errc := fs.Mkdir(p, 0); errc != 0 {
+			t.Fatalf("Mkdir %s, %d", p, errc)
+		}
+	}
+	waitForTxs(t, fs, sent, 2)
+
+	// Snapshots read the pinned start point while compaction moves it
+	compacted := make(chan struct{})
+	go func() {
+		defer close(compacted)
+		if err := fs.compactor.Compact(); err != nil {
+			t.Error(err)
+		}
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				if err := fs.snapshots.Save(); err != nil {
+					t.Error(err)
+				}
+				select {
+				case <-compacted:
+					return
+				default:
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	pinned, err := backend.dg.ChannelMessagesPinned(f.ChannelID(TxChannelName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pinned) != 1 {
+		t.Errorf("got %d pinned messages, want 1", len(pinned))
+	}
+	db, err = loadDB(newTestDiscordBackend(t, f), NewVolume("", false), false, "radix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"/", "/a", "/b"} {
+		if _, ok := db.Get(p); !ok {
+			t.Errorf("path %s is missing", p)
+		}
+	}
+}
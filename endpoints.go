@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// withSlash ensures a base URL ends with a slash
+func withSlash(url string) string {
+	if strings.HasSuffix(url, "/") {
+		return url
+	}
+	return url + "/"
+}
+
+// setEndpoints points discordgo at a Discord-compatible server
+// Empty URLs keep the default endpoints.
+func setEndpoints(api string, cdn string) {
+	if api != "" {
+		discordgo.EndpointAPI = withSlash(api)
+		discordgo.EndpointGuilds = discordgo.EndpointAPI + "guilds/"
+		discordgo.EndpointChannels = discordgo.EndpointAPI + "channels/"
+		discordgo.EndpointUsers = discordgo.EndpointAPI + "users/"
+		discordgo.EndpointGateway = discordgo.EndpointAPI + "gateway"
+		discordgo.EndpointGatewayBot = discordgo.EndpointGateway + "/bot"
+		discordgo.EndpointWebhooks = discordgo.EndpointAPI + "webhooks/"
+		discordgo.EndpointStickers = discordgo.EndpointAPI + "stickers/"
+		discordgo.EndpointStageInstances = discordgo.EndpointAPI + "stage-instances"
+		discordgo.EndpointVoice = discordgo.EndpointAPI + "/voice/"
+		discordgo.EndpointVoiceRegions = discordgo.EndpointVoice + "regions"
+		discordgo.EndpointNitroStickersPacks = discordgo.EndpointAPI + "/sticker-packs"
+		discordgo.EndpointGuildCreate = discordgo.EndpointAPI + "guilds"
+		discordgo.EndpointApplications = discordgo.EndpointAPI + "applications"
+	}
+	if cdn != "" {
+		discordgo.EndpointCDN = withSlash(cdn)
+		discordgo.EndpointCDNAttachments = discordgo.EndpointCDN + "attachments/"
+		discordgo.EndpointCDNAvatars = discordgo.EndpointCDN + "avatars/"
+		discordgo.EndpointCDNIcons = discordgo.EndpointCDN + "icons/"
+		discordgo.EndpointCDNSplashes = discordgo.EndpointCDN + "splashes/"
+		discordgo.EndpointCDNChannelIcons = discordgo.EndpointCDN + "channel-icons/"
+		discordgo.EndpointCDNBanners = discordgo.EndpointCDN + "banners/"
+		discordgo.EndpointCDNGuilds = discordgo.EndpointCDN + "guilds/"
+	}
+}
+
+// attachmentURL builds the URL of an attachment from the configured CDN
+func attachmentURL(channelID string, fileID string, filename string) string {
+	return discordgo.EndpointCDNAttachments + channelID + "/" + fileID + "/" + filename
+}
+
+// signedAttachmentURL builds the URL of an attachment from the configured CDN
+// with the signature of signed, a URL of the same attachment returned by the
+// API
+func signedAttachmentURL(channelID string, fileID string, filename string, signed string) string {
+	base := attachmentURL(channelID, fileID, filename)
+	if _, query, ok := strings.Cut(signed, "?"); ok && query != "" {
+		return base + "?" + query
+	}
+	return base
+}
+
+// gatewayTransport answers gateway lookups with a fixed gateway URL
+// discordgo does not expose a way to set the gateway directly, so the lookup
+// request is intercepted instead.
+type gatewayTransport struct {
+	gateway string
+	next    http.RoundTripper
+}
+
+func (t *gatewayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet || req.URL.String() != discordgo.EndpointGateway {
+		return t.next.RoundTrip(req)
+	}
+	b, _ := json.Marshal(map[string]string{"url": t.gateway})
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/json"}},
+		Body:          io.NopCloser(bytes.NewReader(b)),
+		ContentLength: int64(len(b)),
+		Request:       req,
+	}, nil
+}
+
+// setGateway makes a session connect to gateway instead of the advertised one
+func setGateway(dg *discordgo.Session, gateway string) {
+	if gateway == "" {
+		return
+	}
+	next := dg.Client.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	client := *dg.Client
+	client.Transport = &gatewayTransport{gateway: gateway, next: next}
+	dg.Client = &client
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// ErasureParams stores how many data and parity shards form a stripe
+type ErasureParams struct {
+	K int `json:"k"`
+	M int `json:"m"`
+}
+
+// parseErasure parses erasure coding parameters of the form K+M
+// An empty string disables erasure coding.
+func parseErasure(s string) (*ErasureParams, error) {
+	if s == "" {
+		return nil, nil
+	}
+	k, m, ok := strings.Cut(s, "+")
+	if !ok {
+		return nil, fmt.Errorf("invalid parity %q, expected K+M", s)
+	}
+	params := &ErasureParams{}
+	var err error
+	if params.K, err = strconv.Atoi(k); err != nil {
+		return nil, fmt.Errorf("invalid parity %q, %w", s, err)
+	}
+	if params.M, err = strconv.Atoi(m); err != nil {
+		return nil, fmt.Errorf("invalid parity %q, %w", s, err)
+	}
+	if _, err := NewReedSolomon(params.K, params.M); err != nil {
+		return nil, err
+	}
+	return params, nil
+}
+
+// Arithmetic in GF(2^8) with the polynomial x^8 + x^4 + x^3 + x^2 + 1
+var gfExp, gfLog, gfMulTable = func() ([512]byte, [256]byte, [256][256]byte) {
+	var exp [512]byte
+	var log [256]byte
+	x := 1
+	for i := 0; i < 255; i++ {
+		exp[i] = byte(x)
+		log[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < 512; i++ {
+		exp[i] = exp[i-255]
+	}
+	var mul [256][256]byte
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			mul[a][b] = exp[int(log[a])+int(log[b])]
+		}
+	}
+	return exp, log, mul
+}()
+
+func gfMul(a, b byte) byte {
+	return gfMulTable[a][b]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+func gfPow(a byte, n int) byte {
+	if n == 0 {
+		return 1
+	}
+	if a == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])*n%255]
+}
+
+// gfMatrix is a matrix over GF(2^8)
+type gfMatrix [][]byte
+
+func newGfMatrix(rows, cols int) gfMatrix {
+	m := make(gfMatrix, rows)
+	for r := range m {
+		m[r] = make([]byte, cols)
+	}
+	return m
+}
+
+// mul multiplies m by other
+func (m gfMatrix) mul(other gfMatrix) gfMatrix {
+	out := newGfMatrix(len(m), len(other[0]))
+	for r := range m {
+		for c := range out[r] {
+			var v byte
+			for i := range other {
+				v ^= gfMul(m[r][i], other[i][c])
+			}
+			out[r][c] = v
+		}
+	}
+	return out
+}
+
+// invert inverts a square matrix with Gauss-Jordan elimination
+func (m gfMatrix) invert() (gfMatrix, error) {
+	n := len(m)
+	work := newGfMatrix(n, 2*n)
+	for r := range m {
+		copy(work[r], m[r])
+		work[r][n+r] = 1
+	}
+	for c := 0; c < n; c++ {
+		pivot := c
+		for pivot < n && work[pivot][c] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, errors.New("matrix is singular")
+		}
+		work[c], work[pivot] = work[pivot], work[c]
+		if inv := gfInv(work[c][c]); inv != 1 {
+			for i := range work[c] {
+				work[c][i] = gfMul(work[c][i], inv)
+			}
+		}
+		for r := 0; r < n; r++ {
+			if r == c || work[r][c] == 0 {
+				continue
+			}
+			f := work[r][c]
+			for i := range work[r] {
+				work[r][i] ^= gfMul(f, work[c][i])
+			}
+		}
+	}
+	out := newGfMatrix(n, n)
+	for r := range out {
+		copy(out[r], work[r][n:])
+	}
+	return out, nil
+}
+
+// mulAdd adds c * in to out
+func mulAdd(c byte, in, out []byte) {
+	if c == 0 {
+		return
+	}
+	table := &gfMulTable[c]
+	for i, v := range in {
+		out[i] ^= table[v]
+	}
+}
+
+// ReedSolomon is a systematic Reed-Solomon erasure code over GF(2^8)
+// Any K of the K+M shards of a stripe recover the K data shards.
+type ReedSolomon struct {
+	k, m int
+	// matrix maps data shards to all shards, the first K rows are identity
+	matrix gfMatrix
+}
+
+// NewReedSolomon creates a code with k data and m parity shards
+func NewReedSolomon(k, m int) (*ReedSolomon, error) {
+	if k < 1 || m < 1 || k+m > 256 {
+		return nil, fmt.Errorf("invalid number of shards %d+%d", k, m)
+	}
+	vandermonde := newGfMatrix(k+m, k)
+	for r := range vandermonde {
+		for c := range vandermonde[r] {
+			vandermonde[r][c] = gfPow(byte(r), c)
+		}
+	}
+	top, err := vandermonde[:k].invert()
+	if err != nil {
+		return nil, err
+	}
+	return &ReedSolomon{k: k, m: m, matrix: vandermonde.mul(top)}, nil
+}
+
+// Encode computes the parity shards from the data shards
+// All shards must have the same length.
+func (rs *ReedSolomon) Encode(shards [][]byte) error {
+	if len(shards) != rs.k+rs.m {
+		return errors.New("wrong number of shards")
+	}
+	for i := rs.k; i < len(shards); i++ {
+		for j := range shards[i] {
+			shards[i][j] = 0
+		}
+		for j := 0; j < rs.k; j++ {
+			mulAdd(rs.matrix[i][j], shards[j], shards[i])
+		}
+	}
+	return nil
+}
+
+// Reconstruct recovers missing data shards, which are given as nil
+// Parity shards are not recovered.
+func (rs *ReedSolomon) Reconstruct(shards [][]byte) error {
+	if len(shards) != rs.k+rs.m {
+		return errors.New("wrong number of shards")
+	}
+	var rows []int
+	size := 0
+	for i, shard := range shards {
+		if shard != nil && len(rows) < rs.k {
+			rows = append(rows, i)
+			size = len(shard)
+		}
+	}
+	if len(rows) < rs.k {
+		return fmt.Errorf("%d of %d shards are required", rs.k, len(shards))
+	}
+
+	sub := make(gfMatrix, rs.k)
+	for i, row := range rows {
+		sub[i] = rs.matrix[row]
+	}
+	decode, err := sub.invert()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < rs.k; i++ {
+		if shards[i] != nil {
+			continue
+		}
+		shard := make([]byte, size)
+		for j, row := range rows {
+			mulAdd(decode[i][j], shards[row], shard)
+		}
+		shards[i] = shard
+	}
+	return nil
+}
+
+// sameStripe reports whether the stripe starting at block first has the same
+// blocks in old and tx
+func sameStripe(old, tx *Tx, first, k int) bool {
+	end, oldEnd := first+k, first+k
+	if end > len(tx.Checksums) {
+		end = len(tx.Checksums)
+	}
+	if oldEnd > len(old.Checksums) {
+		oldEnd = len(old.Checksums)
+	}
+	if end != oldEnd {
+		return false
+	}
+	for i := first; i < end; i++ {
+		if tx.Checksums[i] != old.Checksums[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// reconstructBlock recovers block idx of tx from the rest of its stripe
+func (fs *Dsfs) reconstructBlock(tx *Tx, idx int, buffer []byte) (int, error) {
+	k, m := tx.Erasure.K, tx.Erasure.M
+	rs, err := NewReedSolomon(k, m)
+	if err != nil {
+		return 0, err
+	}
+	stripe := idx / k
+	first := stripe * k
+	last := first + k
+	if last > len(tx.FileIDs) {
+		last = len(tx.FileIDs)
+	}
+	if len(tx.Parity) < (stripe+1)*m {
+		return 0, errors.New("missing parity blocks")
+	}
+
+	// Shards are padded to the largest block of the stripe
+	offsets := tx.Offsets()
+	var size int64
+	for i := first; i < last; i++ {
+		if length := offsets[i+1] - offsets[i]; length > size {
+			size = length
+		}
+	}
+
+	shards := make([][]byte, k+m)
+	present := 0
+	// The last stripe is padded with empty blocks
+	for i := last - first; i < k; i++ {
+		shards[i] = make([]byte, size)
+		present++
+	}
+	for i := first; i < last && present < k; i++ {
+		if i == idx {
+			continue
+		}
+		shard := make([]byte, size)
+		n, err := fs.getStoredBlock(tx, i, shard)
+		if err != nil || blockChecksum(shard[:n]) != tx.Checksums[i] {
+			fs.markLost(tx.FileIDs[i])
+			continue
+		}
+		shards[i-first] = shard
+		present++
+	}
+	for p := 0; p < m && present < k; p++ {
+		shard := make([]byte, size)
+		n, err := fs.backend.GetBlob(tx.ParityRef(stripe*m+p), shard)
+		if err != nil || int64(n) != size {
+			fs.markLost(tx.Parity[stripe*m+p])
+			continue
+		}
+		shards[k+p] = shard
+		present++
+	}
+
+	if err := rs.Reconstruct(shards); err != nil {
+		return 0, err
+	}
+	data := shards[idx-first][:offsets[idx+1]-offsets[idx]]
+	if blockChecksum(data) != tx.Checksums[idx] {
+		return 0, errors.New("reconstructed block does not match its checksum")
+	}
+	return copy(buffer, data), nil
+}
+
+// markLost records a stored block that could not be read
+// Lost blocks are not reused when files are written again.
+func (fs *Dsfs) markLost(fileID string) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	fs.lost[fileID] = true
+}
+
+// isLost reports whether a stored block could not be read
+func (fs *Dsfs) isLost(fileID string) bool {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	return fs.lost[fileID]
+}
+
+// markDegraded records a file that was read with reconstructed blocks
+func (fs *Dsfs) markDegraded(path string) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if !fs.degraded[path] {
+		fs.degraded[path] = true
+		zap.S().Warnw("file is degraded, rewrite it to restore its redundancy",
+			"path", path, "degraded", len(fs.degraded),
+		)
+	}
+}
+
+// Degraded returns the number of files read with reconstructed blocks
+func (fs *Dsfs) Degraded() int {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	return len(fs.degraded)
+}
+
+// CheckVolume reads every block of every file and returns the paths of files
+// that are degraded and of files that cannot be recovered
+func (fs *Dsfs) CheckVolume() (files int, degraded []string, lost []string) {
+	var txs []*Tx
+	fs.lock.Lock()
+	it := fs.db.Iterator("/")
+	for _, tx, ok := it.Next(); ok; _, tx, ok = it.Next() {
+		if tx.Type == FileType {
+			txs = append(txs, tx)
+		}
+	}
+	fs.lock.Unlock()
+
+	buffer := make([]byte, FileBlockSize)
+	for _, tx := range txs {
+		for idx := range tx.FileIDs {
+			if _, err := fs.getBlock(tx, idx, buffer); err != nil {
+				zap.S().Errorw("file is lost", "path", tx.Path, "error", err)
+				lost = append(lost, tx.Path)
+				break
+			}
+		}
+	}
+	fs.lock.Lock()
+	for path := range fs.degraded {
+		degraded = append(degraded, path)
+	}
+	fs.lock.Unlock()
+	sort.Strings(degraded)
+	return len(txs), degraded, lost
+}
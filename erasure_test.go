@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReedSolomon(t *testing.T) {
+	rs, err := NewReedSolomon(4, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	random := rand.New(rand.NewSource(1))
+	shards := make([][]byte, 6)
+	for i := range shards {
+		shards[i] = make([]byte, 1000)
+		if i < 4 {
+			random.Read(shards[i])
+		}
+	}
+	if err := rs.Encode(shards); err != nil {
+		t.Fatal(err)
+	}
+
+	// Any 2 lost shards can be recovered
+	for a := 0; a < 6; a++ {
+		for b := a + 1; b < 6; b++ {
+			damaged := make([][]byte, 6)
+			copy(damaged, shards)
+			damaged[a], damaged[b] = nil, nil
+			if err := rs.Reconstruct(damaged); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 4; i++ {
+				if !bytes.Equal(damaged[i], shards[i]) {
+					t.Fatalf("shard %d differs after losing %d and %d", i, a, b)
+				}
+			}
+		}
+	}
+
+	damaged := make([][]byte, 6)
+	copy(damaged, shards)
+	damaged[0], damaged[1], damaged[2] = nil, nil, nil
+	if err := rs.Reconstruct(damaged); err == nil {
+		t.Error("expected reconstruction with too few shards to fail")
+	}
+
+	for _, s := range []string{"4", "0+2", "4+x", "200+100"} {
+		if _, err := parseErasure(s); err == nil {
+			t.Errorf("expected %q to be rejected", s)
+		}
+	}
+}
+
+func TestErasureRecovery(t *testing.T) {
+	dir := t.TempDir()
+	fs := newTestDsfs(t, newTestLocalBackend(t, dir))
+	fs.erasure = &ErasureParams{K: 2, M: 1}
+
+	data := make([]byte, 20<<20)
+	rand.New(rand.NewSource(3)).Read(data)
+	tx := writeFile(t, fs, "/file", data)
+	if len(tx.FileIDs) < 2 || len(tx.Parity) != (len(tx.FileIDs)+1)/2 {
+		t.Fatalf("unexpected blocks %d and parity %d", len(tx.FileIDs), len(tx.Parity))
+	}
+
+	// Lose a data block
+	if err := os.Remove(filepath.Join(dir, DataChannelName, tx.FileIDs[1])); err != nil {
+		t.Fatal(err)
+	}
+	fs = newTestDsfs(t, newTestLocalBackend(t, dir))
+	if got := readFile(t, fs, "/file", len(data)); !bytes.Equal(got, data) {
+		t.Fatal("reconstructed file does not match")
+	}
+	if fs.Degraded() != 1 {
+		t.Errorf("expected 1 degraded file, got %d", fs.Degraded())
+	}
+
+	// Losing a second block of the same stripe is fatal
+	if err := os.Remove(filepath.Join(dir, DataChannelName, tx.Parity[0])); err != nil {
+		t.Fatal(err)
+	}
+	fs = newTestDsfs(t, newTestLocalBackend(t, dir))
+	files, _, lost := fs.CheckVolume()
+	if files != 1 || len(lost) != 1 {
+		t.Errorf("expected 1 lost file of 1, got %d of %d", len(lost), files)
+	}
+}
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/gorilla/websocket"
+)
+
+// fakeBotID is the user ID of the session connected to the fake server
+const fakeBotID = "1"
+
+// FakeDiscord emulates the subset of the Discord REST API, gateway and CDN
+// used by dsfs so that the Discord backend can be tested without network
+// access.
+type FakeDiscord struct {
+	*httptest.Server
+	guildID        string
+	channels       map[string]*discordgo.Channel
+	messages       map[string][]*discordgo.Message
+	pins           map[string][]string
+	blobs          map[string][]byte
+	conns          []*fakeGatewayConn
+	nextID         uint64
+	gatewayLookups int
+	// Attachment URLs are signed and expire after urlTTL if it is set
+	urlTTL         time.Duration
+	urlSecret      []byte
+	messageLookups int
+	urlRefreshes   int
+	lock           sync.Mutex
+}
+
+type fakeGatewayConn struct {
+	conn *websocket.Conn
+	seq  int64
+	lock sync.Mutex
+}
+
+// newFakeDiscord starts a FakeDiscord server and points discordgo at it
+// The previous endpoints are restored when the test finishes.
+func newFakeDiscord(t *testing.T) *FakeDiscord {
+	f := &FakeDiscord{
+		channels: make(map[string]*discordgo.Channel),
+		messages: make(map[string][]*discordgo.Message),
+		pins:     make(map[string][]string),
+		blobs:    make(map[string][]byte),
+		nextID:   1000,
+	}
+	f.guildID = f.newID()
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+
+	api, cdn := discordgo.EndpointAPI, discordgo.EndpointCDN
+	setEndpoints(f.URL+"/api", f.URL+"/cdn")
+	t.Cleanup(func() {
+		f.Close()
+		setEndpoints(api, cdn)
+	})
+	return f
+}
+
+// GatewayURL returns the websocket URL of the fake gateway
+func (f *FakeDiscord) GatewayURL() string {
+	return "ws" + strings.TrimPrefix(f.URL, "http") + "/ws"
+}
+
+// newID generates snowflake-like IDs that sort numerically by creation time
+func (f *FakeDiscord) newID() string {
+	f.nextID++
+	return strconv.FormatUint(f.nextID, 10)
+}
+
+func idLess(a, b string) bool {
+	x, _ := strconv.ParseUint(a, 10, 64)
+	y, _ := strconv.ParseUint(b, 10, 64)
+	return x < y
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func (f *FakeDiscord) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 2 && parts[0] == "api" && parts[1] == "gateway":
+		f.lock.Lock()
+		f.gatewayLookups++
+		f.lock.Unlock()
+		writeJSON(w, map[string]string{"url": f.GatewayURL()})
+	case len(parts) == 1 && parts[0] == "ws":
+		f.serveGateway(w, r)
+	case len(parts) == 5 && parts[0] == "cdn" && parts[1] == "attachments":
+		f.lock.Lock()
+		data, ok := f.blobs[parts[3]]
+		if ok && f.urlTTL != 0 {
+			ok = f.verifyURL(parts[3], r.URL.Query())
+		}
+		f.lock.Unlock()
+		if !ok {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(data)
+	case len(parts) == 3 && parts[0] == "api" && parts[1] == "attachments" && parts[2] == "refresh-urls":
+		f.serveRefreshURLs(w, r)
+	case len(parts) == 4 && parts[0] == "api" && parts[1] == "guilds" && parts[3] == "channels":
+		f.serveGuildChannels(w, r)
+	case len(parts) >= 4 && parts[0] == "api" && parts[1] == "channels":
+		f.serveChannel(w, r, parts[2], parts[3:])
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+func (f *FakeDiscord) serveGuildChannels(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	switch r.Method {
+	case http.MethodGet:
+		channels := make([]*discordgo.Channel, 0, len(f.channels))
+		for _, channel := range f.channels {
+			channels = append(channels, channel)
+		}
+		writeJSON(w, channels)
+	case http.MethodPost:
+		var data struct {
+			Name string                `json:"name"`
+			Type discordgo.ChannelType `json:"type"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		channel := &discordgo.Channel{
+			ID:      f.newID(),
+			GuildID: f.guildID,
+			Name:    data.Name,
+			Type:    data.Type,
+		}
+		f.channels[channel.ID] = channel
+		writeJSON(w, channel)
+	}
+}
+
+func (f *FakeDiscord) serveChannel(w http.ResponseWriter, r *http.Request, channelID string, parts []string) {
+	if _, ok := f.channel(channelID); !ok {
+		http.Error(w, "unknown channel", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case parts[0] == "messages" && len(parts) == 1 && r.Method == http.MethodPost:
+		// Messages without attachments are sent as JSON
+		if !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+			var data struct {
+				Content string `json:"content"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			writeJSON(w, f.postMessage(channelID, fakeBotID, data.Content, nil, nil))
+			return
+		}
+		if err := r.ParseMultipartForm(64 << 20); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var files [][]byte
+		var names []string
+		for i := 0; ; i++ {
+			headers := r.MultipartForm.File[fmt.Sprintf("files[%d]", i)]
+			if len(headers) == 0 {
+				break
+			}
+			file, err := headers[0].Open()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			data, _ := io.ReadAll(file)
+			file.Close()
+			files = append(files, data)
+			names = append(names, headers[0].Filename)
+		}
+		writeJSON(w, f.PostMessage(channelID, fakeBotID, names, files))
+	case parts[0] == "messages" && len(parts) == 1 && r.Method == http.MethodGet:
+		writeJSON(w, f.listMessages(channelID, r.URL.Query()))
+	case parts[0] == "messages" && len(parts) == 2 && r.Method == http.MethodGet:
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		f.messageLookups++
+		for _, m := range f.messages[channelID] {
+			if m.ID == parts[1] {
+				writeJSON(w, f.signed(m))
+				return
+			}
+		}
+		http.Error(w, "unknown message", http.StatusNotFound)
+	case parts[0] == "messages" && len(parts) == 2 && r.Method == http.MethodDelete:
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		messages := f.messages[channelID]
+		for i, m := range messages {
+			if m.ID == parts[1] {
+				f.messages[channelID] = append(messages[:i:i], messages[i+1:]...)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		http.Error(w, "unknown message", http.StatusNotFound)
+	case parts[0] == "pins" && len(parts) == 1 && r.Method == http.MethodGet:
+		f.lock.Lock()
+		pinned := make([]*discordgo.Message, 0)
+		for _, id := range f.pins[channelID] {
+			for _, m := range f.messages[channelID] {
+				if m.ID == id {
+					pinned = append(pinned, f.signed(m))
+				}
+			}
+		}
+		f.lock.Unlock()
+		writeJSON(w, pinned)
+	case parts[0] == "pins" && len(parts) == 2 && r.Method == http.MethodPut:
+		f.lock.Lock()
+		f.pins[channelID] = append(f.pins[channelID], parts[1])
+		now := time.Now()
+		f.channels[channelID].LastPinTimestamp = &now
+		f.lock.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	case parts[0] == "pins" && len(parts) == 2 && r.Method == http.MethodDelete:
+		f.lock.Lock()
+		pins := f.pins[channelID][:0]
+		for _, id := range f.pins[channelID] {
+			if id != parts[1] {
+				pins = append(pins, id)
+			}
+		}
+		f.pins[channelID] = pins
+		f.lock.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+// listMessages returns messages in descending order like Discord does
+func (f *FakeDiscord) listMessages(channelID string, query map[string][]string) []*discordgo.Message {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	get := func(key string) string {
+		if v := query[key]; len(v) != 0 {
+			return v[0]
+		}
+		return ""
+	}
+	limit, err := strconv.Atoi(get("limit"))
+	if err != nil || limit <= 0 || limit > MaxDiscordMessageRequest {
+		limit = 50
+	}
+	after, before := get("after"), get("before")
+
+	var selected []*discordgo.Message
+	for _, m := range f.messages[channelID] {
+		if after != "" && !idLess(after, m.ID) {
+			continue
+		}
+		if before != "" && !idLess(m.ID, before) {
+			continue
+		}
+		selected = append(selected, m)
+	}
+	// Messages after an ID are taken from the oldest, otherwise from the newest
+	if after != "" {
+		if len(selected) > limit {
+			selected = selected[:limit]
+		}
+	} else if len(selected) > limit {
+		selected = selected[len(selected)-limit:]
+	}
+	sort.Slice(selected, func(i, j int) bool {
+		return idLess(selected[j].ID, selected[i].ID)
+	})
+	for i, m := range selected {
+		selected[i] = f.signed(m)
+	}
+	return selected
+}
+
+// channel looks up a channel by ID
+func (f *FakeDiscord) channel(id string) (*discordgo.Channel, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	channel, ok := f.channels[id]
+	return channel, ok
+}
+
+// ChannelID looks up a channel ID by name
+func (f *FakeDiscord) ChannelID(name string) string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for id, channel := range f.channels {
+		if channel.Name == name {
+			return id
+		}
+	}
+	return ""
+}
+
+// Messages returns the messages of a channel in the order they were sent
+func (f *FakeDiscord) Messages(channelID string) []*discordgo.Message {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]*discordgo.Message(nil), f.messages[channelID]...)
+}
+
+// PostMessage stores a message with attachments and emits MESSAGE_CREATE
+func (f *FakeDiscord) PostMessage(channelID string, authorID string, names []string, files [][]byte) *discordgo.Message {
+	return f.postMessage(channelID, authorID, "", names, files)
+}
+
+// postMessage stores a message with content and attachments and emits
+// MESSAGE_CREATE
+func (f *FakeDiscord) postMessage(channelID string, authorID string, content string, names []string, files [][]byte) *discordgo.Message {
+	f.lock.Lock()
+	m := &discordgo.Message{
+		ID:        f.newID(),
+		ChannelID: channelID,
+		GuildID:   f.guildID,
+		Content:   content,
+		Timestamp: time.Now(),
+		Author:    &discordgo.User{ID: authorID, Username: "user" + authorID},
+	}
+	for i, data := range files {
+		id := f.newID()
+		f.blobs[id] = data
+		m.Attachments = append(m.Attachments, &discordgo.MessageAttachment{
+			ID:       id,
+			URL:      f.signURL(channelID, id, names[i]),
+			Filename: names[i],
+			Size:     len(data),
+		})
+	}
+	f.messages[channelID] = append(f.messages[channelID], m)
+	conns := append([]*fakeGatewayConn(nil), f.conns...)
+	f.lock.Unlock()
+
+	for _, conn := range conns {
+		conn.dispatch("MESSAGE_CREATE", m)
+	}
+	return m
+}
+
+// SignURLs makes attachment URLs expire after ttl
+func (f *FakeDiscord) SignURLs(ttl time.Duration) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.urlTTL = ttl
+	f.urlSecret = []byte(f.newID())
+}
+
+// RevokeURLs invalidates every signed URL handed out so far
+func (f *FakeDiscord) RevokeURLs() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.urlSecret = []byte(f.newID())
+}
+
+// signature computes the hm parameter of a signed URL
+func (f *FakeDiscord) signature(id string, ex string) string {
+	mac := hmac.New(sha256.New, f.urlSecret)
+	mac.Write([]byte(id + ex))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signURL builds the URL of an attachment, signed if URLs expire
+func (f *FakeDiscord) signURL(channelID string, id string, name string) string {
+	url := attachmentURL(channelID, id, name)
+	if f.urlTTL == 0 {
+		return url
+	}
+	now := time.Now()
+	ex := strconv.FormatInt(now.Add(f.urlTTL).Unix(), 16)
+	is := strconv.FormatInt(now.Unix(), 16)
+	return url + "?ex=" + ex + "&is=" + is + "&hm=" + f.signature(id, ex)
+}
+
+// verifyURL checks the signature and expiry of an attachment URL
+func (f *FakeDiscord) verifyURL(id string, query map[string][]string) bool {
+	get := func(key string) string {
+		if v := query[key]; len(v) != 0 {
+			return v[0]
+		}
+		return ""
+	}
+	ex, err := strconv.ParseInt(get("ex"), 16, 64)
+	if err != nil || time.Now().Unix() >= ex {
+		return false
+	}
+	return hmac.Equal([]byte(get("hm")), []byte(f.signature(id, get("ex"))))
+}
+
+// signed copies a message with freshly signed attachment URLs
+func (f *FakeDiscord) signed(m *discordgo.Message) *discordgo.Message {
+	c := *m
+	c.Attachments = make([]*discordgo.MessageAttachment, len(m.Attachments))
+	for i, attachment := range m.Attachments {
+		a := *attachment
+		a.URL = f.signURL(m.ChannelID, a.ID, a.Filename)
+		c.Attachments[i] = &a
+	}
+	return &c
+}
+
+// serveRefreshURLs signs attachment URLs again
+func (f *FakeDiscord) serveRefreshURLs(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		AttachmentURLs []string `json:"attachment_urls"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.urlRefreshes++
+	type refreshed struct {
+		Original  string `json:"original"`
+		Refreshed string `json:"refreshed"`
+	}
+	urls := make([]refreshed, 0)
+	for _, original := range data.AttachmentURLs {
+		path, _, _ := strings.Cut(original, "?")
+		parts := strings.Split(path, "/")
+		if len(parts) < 3 {
+			continue
+		}
+		channelID, id, name := parts[len(parts)-3], parts[len(parts)-2], parts[len(parts)-1]
+		if _, ok := f.blobs[id]; ok {
+			urls = append(urls, refreshed{Original: original, Refreshed: f.signURL(channelID, id, name)})
+		}
+	}
+	writeJSON(w, map[string]interface{}{"refreshed_urls": urls})
+}
+
+// serveGateway runs a minimal gateway that identifies the session and
+// acknowledges heartbeats
+func (f *FakeDiscord) serveGateway(w http.ResponseWriter, r *http.Request) {
+	upgrader := websocket.Upgrader{}
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	conn := &fakeGatewayConn{conn: ws}
+	defer ws.Close()
+
+	conn.send(map[string]interface{}{
+		"op": 10,
+		"d":  map[string]interface{}{"heartbeat_interval": 45000},
+	})
+
+	for {
+		var payload struct {
+			Op int `json:"op"`
+		}
+		if err := ws.ReadJSON(&payload); err != nil {
+			return
+		}
+		switch payload.Op {
+		case 1:
+			conn.send(map[string]interface{}{"op": 11})
+		case 2:
+			conn.dispatch("READY", map[string]interface{}{
+				"v":          9,
+				"session_id": "fake",
+				"user":       &discordgo.User{ID: fakeBotID, Username: "dsfs", Bot: true},
+				"guilds":     []interface{}{},
+			})
+			f.lock.Lock()
+			f.conns = append(f.conns, conn)
+			f.lock.Unlock()
+		}
+	}
+}
+
+func (c *fakeGatewayConn) send(v interface{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	_ = c.conn.WriteJSON(v)
+}
+
+func (c *fakeGatewayConn) dispatch(event string, data interface{}) {
+	c.lock.Lock()
+	c.seq++
+	seq := c.seq
+	c.lock.Unlock()
+	c.send(map[string]interface{}{"op": 0, "t": event, "s": seq, "d": data})
+}
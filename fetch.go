@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"sort"
+)
+
+// blockSpan returns the blocks of offsets overlapping range [start, end)
+// last is smaller than first if no block overlaps.
+func blockSpan(offsets []int64, start, end int64) (first, last int) {
+	if len(offsets) < 2 || start >= end {
+		return 0, -1
+	}
+	first = sort.Search(len(offsets)-1, func(i int) bool { return offsets[i+1] > start })
+	last = sort.Search(len(offsets)-1, func(i int) bool { return offsets[i+1] >= end })
+	if last > len(offsets)-2 {
+		last = len(offsets) - 2
+	}
+	return first, last
+}
+
+// truncateOffsets drops the parts of blocks past size
+// Bytes past size are zeros once the file grows again.
+func truncateOffsets(offsets []int64, size int64) []int64 {
+	truncated := make([]int64, len(offsets))
+	for i, ofst := range offsets {
+		if ofst > size {
+			ofst = size
+		}
+		truncated[i] = ofst
+	}
+	return truncated
+}
+
+// blockFetch is a scheduled download of a block
+type blockFetch struct {
+	done chan struct{}
+	job  *Job
+}
+
+// fetchBlock schedules downloading block idx of the version file was opened
+// at unless it is present or already being downloaded.
+// The returned channel is closed once the download finishes. The caller must
+// hold file.lock.
+func (fs *Dsfs) fetchBlock(file *FileData, idx int, priority Priority) <-chan struct{} {
+	if fetch, ok := file.fetches[idx]; ok {
+		if priority == ReadPriority {
+			fs.downloads.Promote(fetch.job)
+		}
+		return fetch.done
+	}
+	done := make(chan struct{})
+	start, end := file.offsets[idx], file.offsets[idx+1]
+	if filesize := file.cache.Size(); end > filesize {
+		end = filesize
+	}
+	if start >= end || file.load.isReady(start, end) {
+		close(done)
+		return done
+	}
+	fetch := &blockFetch{done: done}
+	file.fetches[idx] = fetch
+
+	tx := file.tx
+	fetch.job = fs.downloads.Submit(priority, func() {
+		defer close(done)
+		// Offsets may be truncated, blocks never exceed FileBlockSize
+		buffer := make([]byte, FileBlockSize)
+		n, err := fs.getBlock(tx, idx, buffer)
+
+		file.lock.Lock()
+		defer file.lock.Unlock()
+		if file.fetches[idx] == fetch {
+			delete(file.fetches, idx)
+		}
+		// Errors are logged by getBlock and surface as EIO in Read
+		if err != nil {
+			return
+		}
+		// The file was replaced by a newer version in the meantime
+		if file.tx != tx {
+			return
+		}
+
+		// Ranges written locally in the meantime are kept
+		end := start + int64(n)
+		if filesize := file.cache.Size(); end > filesize {
+			end = filesize
+		}
+		for _, gap := range file.load.missing(start, end) {
+			file.cache.WriteRange(gap.start, gap.end, buffer[gap.start-start:gap.end-start])
+			file.load.addRange(gap.start, gap.end)
+		}
+	})
+	return done
+}
+
+// fetchRange downloads the blocks overlapping range [start, end) that are not
+// present and starts downloading up to readAhead blocks after them.
+func (fs *Dsfs) fetchRange(file *FileData, start, end int64, readAhead int) error {
+	file.lock.Lock()
+	tx := file.tx
+	first, last := blockSpan(file.offsets, start, end)
+	waits := make([]<-chan struct{}, 0, last-first+1)
+	for idx := first; idx <= last; idx++ {
+		waits = append(waits, fs.fetchBlock(file, idx, ReadPriority))
+	}
+	for idx := last + 1; idx <= last+readAhead && idx < len(file.offsets)-1; idx++ {
+		fs.fetchBlock(file, idx, PrefetchPriority)
+	}
+	file.lock.Unlock()
+
+	for _, done := range waits {
+		<-done
+	}
+
+	file.lock.Lock()
+	if filesize := file.cache.Size(); end > filesize {
+		end = filesize
+	}
+	ready := start >= end || file.load.isReady(start, end)
+	replaced := file.tx != tx
+	file.lock.Unlock()
+
+	if ready {
+		return nil
+	}
+	// Downloads of a version replaced in the meantime are discarded
+	if replaced {
+		return fs.fetchRange(file, start, end, readAhead)
+	}
+	return errors.New("failed to fetch data blocks")
+}
+
+// fetchAll downloads every block of file that is not present
+func (fs *Dsfs) fetchAll(file *FileData) error {
+	file.lock.Lock()
+	var end int64
+	if len(file.offsets) > 0 {
+		end = file.offsets[len(file.offsets)-1]
+	}
+	file.lock.Unlock()
+	return fs.fetchRange(file, 0, end, 0)
+}
@@ -1,29 +1,55 @@
 package main
 
 import (
+	"bytes"
 	"crypto/sha1"
 	"encoding/base64"
 	"errors"
+	"fmt"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/bwmarrin/discordgo"
 	"github.com/darenliang/dsfs/fuse"
 	"go.uber.org/zap"
 )
 
 type Dsfs struct {
 	fuse.FileSystemBase
-	dg          *discordgo.Session
-	db          DB
-	writer      *Writer
-	txChannel   *discordgo.Channel
-	dataChannel *discordgo.Channel
-	open        map[string]*FileData
-	lock        sync.Mutex
-	cacheType   string
+	backend   Backend
+	volume    *Volume
+	db        DB
+	writer    *Writer
+	downloads *Scheduler
+	open      map[string]*FileData
+	lock      sync.Mutex
+	cacheType string
+	codec     Codec
+	erasure   *ErasureParams
+	// Files that were read with reconstructed blocks and the blocks that
+	// could not be read
+	degraded map[string]bool
+	lost     map[string]bool
+	// compactor compacts the tx log while the volume is mounted
+	compactor *Compactor
+	// snapshots saves the DB snapshot while the volume is mounted
+	snapshots *Snapshotter
+	leaser    *Leaser
+	// trash is how long deleted items are kept in TrashDir, items are
+	// deleted right away if it is zero
+	trash time.Duration
+	// readOnly makes every mutating operation fail with EROFS
+	readOnly atomic.Bool
+	// exclusive mounts are read-only once the lease of leaser is lost
+	exclusive bool
+	// unsent counts the changes to the tree whose tx batch was not appended
+	// yet, including batches that failed to send
+	// It is raised under fs.lock together with the change.
+	unsent     atomic.Int64
+	sendFailed atomic.Bool
 }
 
 type FileData struct {
@@ -34,24 +60,142 @@ type FileData struct {
 	cache   Cache
 	lock    sync.RWMutex
 	dirty   bool
+	// Blocks that are not loaded are fetched from tx on demand
+	tx      *Tx
+	offsets []int64
+	fetches map[int]*blockFetch
 }
 
-func NewDsfs(dg *discordgo.Session, db DB, writer *Writer, txChannel *discordgo.Channel, dataChannel *discordgo.Channel, cacheType string) *Dsfs {
+func NewDsfs(backend Backend, volume *Volume, db DB, writer *Writer, downloads *Scheduler, cacheType string, codec Codec, erasure *ErasureParams) *Dsfs {
 	dsfs := Dsfs{}
-	dsfs.dg = dg
+	dsfs.backend = backend
+	dsfs.volume = volume
 	dsfs.db = db
 	dsfs.writer = writer
-	dsfs.txChannel = txChannel
-	dsfs.dataChannel = dataChannel
+	dsfs.downloads = downloads
 	dsfs.open = make(map[string]*FileData)
 	dsfs.cacheType = cacheType
+	dsfs.codec = codec
+	dsfs.erasure = erasure
+	dsfs.degraded = make(map[string]bool)
+	dsfs.lost = make(map[string]bool)
 	return &dsfs
 }
 
+// sendTx sends a tx batch and records its message for the given txs that
+// were not replaced in the meantime
+func (fs *Dsfs) sendTx(b []byte, txs ...*Tx) {
+	id, err := fs.writer.SendTx(b)
+	if err != nil {
+		zap.S().Warnw("failed to send tx", "error", err)
+		fs.sendFailed.Store(true)
+		return
+	}
+	fs.lock.Lock()
+	for _, tx := range txs {
+		if current, ok := fs.db.Get(tx.Path); ok && current == tx {
+			fs.db.SetMessage(tx.Path, id)
+		}
+	}
+	fs.volume.applied(id)
+	fs.unsent.Add(-1)
+	fs.lock.Unlock()
+	fs.logTx(id, b)
+}
+
+// waitForSends waits until the tx batches of every change to the tree were
+// sent, a send failed or timeout passed
+func (fs *Dsfs) waitForSends(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for fs.unsent.Load() != 0 {
+		if fs.sendFailed.Load() || time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+// logTx records a plaintext tx batch that was appended to the log and applied
+// to the tree
+func (fs *Dsfs) logTx(id string, b []byte) {
+	fs.volume.countTxs(b)
+	if fs.compactor != nil {
+		fs.compactor.Record(TxRecord{ID: id, Data: b})
+	}
+	if fs.snapshots != nil {
+		fs.snapshots.Record(len(txLines(b)))
+	}
+}
+
+// getBlock downloads and decodes block idx of tx and writes to buffer
+// Blocks are verified against their checksum and downloaded again with
+// backoff on mismatch. Blocks of files with parity are reconstructed if they
+// stay unreadable.
+func (fs *Dsfs) getBlock(tx *Tx, idx int, buffer []byte) (int, error) {
+	var n int
+	var err error
+	backoff := BlockRetryBackoff
+	for attempt := 1; ; attempt++ {
+		n, err = fs.getStoredBlock(tx, idx, buffer)
+		if err != nil {
+			break
+		}
+		if idx >= len(tx.Checksums) || blockChecksum(buffer[:n]) == tx.Checksums[idx] {
+			return n, nil
+		}
+		err = errors.New("checksum mismatch")
+		if attempt == BlockRetries {
+			break
+		}
+		zap.S().Warnw("data block does not match its checksum, retrying",
+			"path", tx.Path, "id", tx.FileIDs[idx], "attempt", attempt,
+		)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+
+	if tx.Erasure == nil {
+		zap.S().Errorw("failed to get data block", "path", tx.Path, "id", tx.FileIDs[idx], "error", err)
+		return 0, fmt.Errorf("block %s, %w", tx.FileIDs[idx], err)
+	}
+	zap.S().Warnw("reconstructing data block from parity", "path", tx.Path, "id", tx.FileIDs[idx], "error", err)
+	fs.markLost(tx.FileIDs[idx])
+	n, err = fs.reconstructBlock(tx, idx, buffer)
+	if err != nil {
+		zap.S().Errorw("failed to reconstruct data block", "path", tx.Path, "id", tx.FileIDs[idx], "error", err)
+		return 0, fmt.Errorf("failed to reconstruct block %s, %w", tx.FileIDs[idx], err)
+	}
+	fs.markDegraded(tx.Path)
+	return n, nil
+}
+
+// getStoredBlock downloads and decodes block idx of tx and writes to buffer
+func (fs *Dsfs) getStoredBlock(tx *Tx, idx int, buffer []byte) (int, error) {
+	codec := tx.Codec(idx)
+	if codec == RawCodec {
+		return fs.backend.GetBlob(tx.BlockRef(idx), buffer)
+	}
+	// Encoded blocks are never larger than the decoded block
+	data := make([]byte, len(buffer))
+	n, err := fs.backend.GetBlob(tx.BlockRef(idx), data)
+	if err != nil {
+		return 0, err
+	}
+	n, err = decodeBlock(data[:n], codec, buffer)
+	if err != nil {
+		return 0, fmt.Errorf("failed to decode block %s, %w", tx.FileIDs[idx], err)
+	}
+	return n, nil
+}
+
 func (fs *Dsfs) Mknod(path string, mode uint32, dev uint64) int {
 	zap.S().Debugw("Mknod",
 		"path", path, "mode", mode, "dev", dev,
 	)
+	if fs.readOnlyPath(path) {
+		return -fuse.EROFS
+	}
 	fs.lock.Lock()
 	defer fs.lock.Unlock()
 
@@ -76,6 +220,7 @@ func (fs *Dsfs) Mknod(path string, mode uint32, dev uint64) int {
 		syncing: &atomic.Bool{},
 		mtim:    time.Now(),
 		ctim:    time.Now(),
+		fetches: make(map[int]*blockFetch),
 	}
 
 	return 0
@@ -83,6 +228,9 @@ func (fs *Dsfs) Mknod(path string, mode uint32, dev uint64) int {
 
 func (fs *Dsfs) Mkdir(path string, mode uint32) int {
 	zap.S().Debugw("Mkdir", "path", path, "mode", mode)
+	if fs.readOnlyPath(path) {
+		return -fuse.EROFS
+	}
 	fs.lock.Lock()
 
 	// Check parent in db
@@ -103,21 +251,25 @@ func (fs *Dsfs) Mkdir(path string, mode uint32) int {
 		Path: path,
 		Type: FolderType,
 	}
-	fs.db.Insert(path, tx)
-	fs.lock.Unlock()
-
-	b, _ := json.Marshal(tx)
-	if len(b) > MaxDiscordFileSize {
+	b := encodeTx(*tx)
+	if len(b) > MaxDiscordFileSize-fs.volume.TxOverhead() {
+		fs.lock.Unlock()
 		return -fuse.EACCES
 	}
+	fs.db.Insert(path, tx)
+	fs.unsent.Add(1)
+	fs.lock.Unlock()
 
-	go func() { fs.writer.SendTx(b) }()
+	go func() { fs.sendTx(b, tx) }()
 
 	return 0
 }
 
 func (fs *Dsfs) Open(path string, flags int) (int, uint64) {
 	zap.S().Debugw("Open", "path", path, "flags", flags)
+	if flags&fuse.O_ACCMODE != fuse.O_RDONLY && fs.readOnlyPath(path) {
+		return -fuse.EROFS, ^uint64(0)
+	}
 	fs.lock.Lock()
 
 	// Check open map
@@ -126,6 +278,15 @@ func (fs *Dsfs) Open(path string, flags int) (int, uint64) {
 		return 0, 1
 	}
 
+	if isVirtual(path) {
+		errc := fs.openVersion(path)
+		fs.lock.Unlock()
+		if errc != 0 {
+			return errc, ^uint64(0)
+		}
+		return 0, 1
+	}
+
 	tx, ok := fs.db.Get(path)
 	if !ok {
 		fs.lock.Unlock()
@@ -137,6 +298,7 @@ func (fs *Dsfs) Open(path string, flags int) (int, uint64) {
 		return 0, 1
 	}
 
+	// Blocks are fetched on demand by Read
 	cache := fs.GetNewCache()
 	cache.Truncate(tx.Size)
 	fs.open[path] = &FileData{
@@ -145,75 +307,20 @@ func (fs *Dsfs) Open(path string, flags int) (int, uint64) {
 		syncing: &atomic.Bool{},
 		mtim:    tx.Mtim,
 		ctim:    tx.Ctim,
+		tx:      tx,
+		offsets: tx.Offsets(),
+		fetches: make(map[int]*blockFetch),
 	}
 	fs.lock.Unlock()
 
-	// Load entire file in mem in the background.
-	// This solution is really hacky and isn't great and loading files
-	// incrementally is preferable.
-	//
-	// If memory is really constrained, it is better to save files in a folder
-	// other than the root folder, since some file explorers like to eagerly
-	// prob files for thumbnails, etc.
-	go func() {
-		buffer := make([]byte, FileBlockSize)
-
-		dlID := func(id string, ofst int) error {
-			file, ok := fs.open[path]
-			if !ok {
-				err := errors.New("file no longer exists")
-				zap.S().Warn(err)
-				return err
-			}
-			n, err := getDataFile(fs.dataChannel.ID, id, buffer)
-			if err != nil {
-				zap.S().Warnw("network error with Discord", "error", err)
-				return err
-			}
-			file.lock.Lock()
-			file.cache.WriteRange(int64(ofst), int64(ofst+n), buffer[:n])
-			file.load.addRange(int64(ofst), int64(ofst+n))
-			file.lock.Unlock()
-			return nil
-		}
-
-		// Quick check to see if file parts exist
-		if len(tx.FileIDs) == 0 {
-			return
-		}
-
-		// Download first piece
-		err := dlID(tx.FileIDs[0], 0)
-		if err != nil {
-			return
-		}
-
-		// Quick check to see if there is only one file part
-		if len(tx.FileIDs) == 1 {
-			return
-		}
-
-		// Download last piece to simulate torrent streaming behavior
-		lastIdx := len(tx.FileIDs) - 1
-		err = dlID(tx.FileIDs[lastIdx], lastIdx*FileBlockSize)
-		if err != nil {
-			return
-		}
-
-		// Download rest in order
-		for i := 1; i < lastIdx; i++ {
-			err = dlID(tx.FileIDs[i], i*FileBlockSize)
-			if err != nil {
-				return
-			}
-		}
-	}()
-
 	return 0, 1
 }
 
 func (fs *Dsfs) Unlink(path string) int {
 	zap.S().Debugw("Unlink", "path", path)
+	if fs.readOnlyPath(path) {
+		return -fuse.EROFS
+	}
 	fs.lock.Lock()
 
 	tx, ok := fs.db.Get(path)
@@ -231,23 +338,32 @@ func (fs *Dsfs) Unlink(path string) int {
 		fs.lock.Unlock()
 		return -fuse.EISDIR
 	}
+	if fs.trashes(path) {
+		fs.lock.Unlock()
+		return fs.moveToTrash(path)
+	}
 
+	b := encodeTx(createDeleteTx(path))
+	if len(b) > MaxDiscordFileSize-fs.volume.TxOverhead() {
+		fs.lock.Unlock()
+		return -fuse.EACCES
+	}
 	delete(fs.open, path)
 	fs.db.Delete(path)
+	fs.unsent.Add(1)
 	fs.lock.Unlock()
+	fs.volume.supersede(tx, nil)
 
-	b, _ := json.Marshal(createDeleteTx(path))
-	if len(b) > MaxDiscordFileSize {
-		return -fuse.EACCES
-	}
-
-	go func() { fs.writer.SendTx(b) }()
+	go func() { fs.sendTx(b) }()
 
 	return 0
 }
 
 func (fs *Dsfs) Rmdir(path string) int {
 	zap.S().Debugw("Rmdir", "path", path)
+	if fs.readOnlyPath(path) {
+		return -fuse.EROFS
+	}
 	fs.lock.Lock()
 
 	tx, ok := fs.db.Get(path)
@@ -268,15 +384,20 @@ func (fs *Dsfs) Rmdir(path string) int {
 			return -fuse.ENOTEMPTY
 		}
 	}
-	fs.db.Delete(path)
-	fs.lock.Unlock()
-
-	b, _ := json.Marshal(createDeleteTx(path))
-	if len(b) > MaxDiscordFileSize {
+	if fs.trashes(path) {
+		fs.lock.Unlock()
+		return fs.moveToTrash(path)
+	}
+	b := encodeTx(createDeleteTx(path))
+	if len(b) > MaxDiscordFileSize-fs.volume.TxOverhead() {
+		fs.lock.Unlock()
 		return -fuse.EACCES
 	}
+	fs.db.Delete(path)
+	fs.unsent.Add(1)
+	fs.lock.Unlock()
 
-	go func() { fs.writer.SendTx(b) }()
+	go func() { fs.sendTx(b) }()
 
 	return 0
 }
@@ -285,11 +406,31 @@ func (fs *Dsfs) Rename(oldpath string, newpath string) int {
 	zap.S().Debugw("Rename",
 		"oldpath", oldpath, "newpath", newpath,
 	)
+	if fs.readOnlyPath(oldpath, newpath) {
+		return -fuse.EROFS
+	}
+	b, txs, errc := fs.rename(oldpath, newpath)
+	if errc != 0 || len(b) == 0 {
+		return errc
+	}
+	go func() { fs.sendTx(b, txs...) }()
+	return 0
+}
+
+// rename moves oldpath to newpath with everything in it and returns the tx
+// batch recording the move of txs, which is empty if the file was never
+// stored
+// Folders are moved in one batch writing every new path before deleting the
+// old ones, so other clients never replay a partially moved tree.
+func (fs *Dsfs) rename(oldpath string, newpath string) ([]byte, []*Tx, int) {
 	fs.lock.Lock()
+	defer fs.lock.Unlock()
 
+	if oldpath == newpath {
+		return nil, nil, 0
+	}
 	if _, ok := fs.db.Get(getDir(newpath)); !ok {
-		fs.lock.Unlock()
-		return -fuse.ENOENT
+		return nil, nil, -fuse.ENOENT
 	}
 
 	tx, ok := fs.db.Get(oldpath)
@@ -298,58 +439,89 @@ func (fs *Dsfs) Rename(oldpath string, newpath string) int {
 		if val, ok := fs.open[oldpath]; ok {
 			fs.open[newpath] = val
 			delete(fs.open, oldpath)
-			fs.lock.Unlock()
-			return 0
+			return nil, nil, 0
 		}
-		fs.lock.Unlock()
-		return -fuse.ENOENT
+		return nil, nil, -fuse.ENOENT
 	}
-	if tx.Type == FolderType {
-		// The same hacky way used for Rmdir.
-		// It's pretty sad that renames won't work because paths are hardcoded.
-		//
-		// Looking for a better solution that would eliminate the need of
-		// hardcoded paths.
-		it := fs.db.Iterator(oldpath)
-		for key, _, ok := it.Next(); ok; key, _, ok = it.Next() {
-			if key != oldpath {
-				fs.lock.Unlock()
-				return -fuse.ENOTEMPTY
-			}
-		}
-	} else {
-		// Check mem for files
-		if val, ok := fs.open[oldpath]; ok {
-			fs.open[newpath] = val
-			delete(fs.open, oldpath)
+	if strings.HasPrefix(newpath, oldpath+"/") {
+		return nil, nil, -fuse.EINVAL
+	}
+	replaced, _ := fs.db.Get(newpath)
+	if replaced != nil {
+		switch {
+		case tx.Type == FolderType && replaced.Type != FolderType:
+			return nil, nil, -fuse.ENOTDIR
+		case tx.Type != FolderType && replaced.Type == FolderType:
+			return nil, nil, -fuse.EISDIR
+		case replaced.Type == FolderType && len(fs.subtree(newpath)) > 1:
+			return nil, nil, -fuse.ENOTEMPTY
 		}
 	}
-	fs.lock.Unlock()
 
-	tx.Path = newpath
-	writeTxBytes, _ := json.Marshal(tx)
-	if len(writeTxBytes) > MaxDiscordFileSize {
-		return -fuse.EACCES
+	// Txs are shared with open files and pending uploads, so the moved
+	// paths get copies
+	moving := fs.subtree(oldpath)
+	moved := make([]Tx, len(moving))
+	txs := make([]*Tx, len(moving))
+	lines := make([][]byte, 0, 2*len(moving))
+	for i, key := range moving {
+		current, _ := fs.db.Get(key)
+		moved[i] = *current
+		next := *current
+		next.Path = newpath + strings.TrimPrefix(key, oldpath)
+		// Items moved out of the trash are restored
+		if key == oldpath && !inTrash(newpath) {
+			next.Trashed = nil
+		}
+		txs[i] = &next
+		lines = append(lines, encodeTx(next))
 	}
-	deleteTxBytes, _ := json.Marshal(createDeleteTx(oldpath))
-	if len(deleteTxBytes) > MaxDiscordFileSize {
-		return -fuse.EACCES
+	// Children are deleted before their folder
+	for i := len(moving) - 1; i >= 0; i-- {
+		lines = append(lines, encodeTx(createDeleteTx(moving[i])))
+	}
+	b := bytes.Join(lines, []byte{'\n'})
+	if len(b) > MaxDiscordFileSize-fs.volume.TxOverhead() {
+		return nil, nil, -fuse.EACCES
 	}
 
-	if len(writeTxBytes)+len(deleteTxBytes) > MaxDiscordFileSize {
-		go func() {
-			fs.writer.SendTx(writeTxBytes)
-			fs.writer.SendTx(deleteTxBytes)
-		}()
-	} else {
-		go func() { fs.writer.SendTx(append(append(writeTxBytes, '\n'), deleteTxBytes...)) }()
+	// The new paths are inserted first so that the messages of their txs
+	// are recorded once the batch was sent
+	for _, key := range moving {
+		fs.db.Delete(key)
 	}
-	fs.lock.Lock()
-	fs.db.Insert(newpath, tx)
-	fs.db.Delete(oldpath)
-	fs.lock.Unlock()
+	for _, tx := range txs {
+		fs.db.Insert(tx.Path, tx)
+	}
+	fs.unsent.Add(1)
+	for key, val := range fs.open {
+		if key == oldpath || strings.HasPrefix(key, oldpath+"/") {
+			fs.open[newpath+strings.TrimPrefix(key, oldpath)] = val
+			delete(fs.open, key)
+		}
+	}
+	if replaced != nil {
+		fs.volume.supersede(replaced, nil)
+	}
+	// Renames delete the old paths, which keeps the txs as their versions
+	for i := range moved {
+		fs.volume.versions.Add(&moved[i])
+	}
+	return b, txs, 0
+}
 
-	return 0
+// subtree returns path and every path in it, parents first
+// fs.lock must be held.
+func (fs *Dsfs) subtree(path string) []string {
+	var keys []string
+	it := fs.db.Iterator(path)
+	for key, _, ok := it.Next(); ok; key, _, ok = it.Next() {
+		if key == path || strings.HasPrefix(key, path+"/") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
 }
 
 func (fs *Dsfs) Getattr(path string, stat *fuse.Stat_t, fh uint64) int {
@@ -357,6 +529,10 @@ func (fs *Dsfs) Getattr(path string, stat *fuse.Stat_t, fh uint64) int {
 	fs.lock.Lock()
 	defer fs.lock.Unlock()
 
+	if isVirtual(path) {
+		return fs.getattrVirtual(path, stat)
+	}
+
 	// Check open map
 	if file, ok := fs.open[path]; ok {
 		stat.Mode = fuse.S_IFREG | 0o777
@@ -386,6 +562,9 @@ func (fs *Dsfs) Truncate(path string, size int64, fh uint64) int {
 	zap.S().Debugw("Truncate",
 		"path", path, "size", size, "fh", fh,
 	)
+	if fs.readOnlyPath(path) {
+		return -fuse.EROFS
+	}
 	fs.lock.Lock()
 
 	file, ok := fs.open[path]
@@ -402,8 +581,9 @@ func (fs *Dsfs) Truncate(path string, size int64, fh uint64) int {
 		return 0
 	} else if size < filesize {
 		file.load.truncate(size)
+		file.offsets = truncateOffsets(file.offsets, size)
 	} else {
-		file.load.addRange(filesize, filesize+size)
+		file.load.addRange(filesize, size)
 	}
 
 	file.cache.Truncate(size)
@@ -430,34 +610,25 @@ func (fs *Dsfs) Read(path string, buff []byte, ofst int64, fh uint64) int {
 	}
 	fs.lock.Unlock()
 
-	buffLen := int64(len(buff))
-	var bytesReady int64
-	retries := 0
-
 	file.lock.RLock()
-	for {
-		filesize := file.cache.Size()
-		bytesReady = file.load.bytesReady(ofst)
-		if bytesReady > 0 {
-			if bytesReady > buffLen {
-				bytesReady = buffLen
-			}
-			if ofst+bytesReady > filesize {
-				bytesReady = filesize - ofst
-			}
-			break
-		}
-		if retries >= MaxRetries {
-			file.lock.RUnlock()
-			return 0
-		}
-		retries++
-		file.lock.RUnlock()
-		time.Sleep(PollInterval)
-		file.lock.RLock()
+	filesize := file.cache.Size()
+	file.lock.RUnlock()
+	if ofst >= filesize {
+		return 0
+	}
+	end := ofst + int64(len(buff))
+	if end > filesize {
+		end = filesize
 	}
 
-	bytesRead := file.cache.ReadRange(ofst, ofst+bytesReady, buff)
+	err := fs.fetchRange(file, ofst, end, ReadAheadBlocks)
+	if err != nil {
+		zap.S().Warnw("failed to read", "path", path, "error", err)
+		return -fuse.EIO
+	}
+
+	file.lock.RLock()
+	bytesRead := file.cache.ReadRange(ofst, end, buff)
 	file.lock.RUnlock()
 
 	return int(bytesRead)
@@ -471,6 +642,9 @@ func (fs *Dsfs) Write(path string, buff []byte, ofst int64, fh uint64) int {
 		"ofst", ofst,
 		"fh", fh,
 	)
+	if fs.readOnlyPath(path) {
+		return -fuse.EROFS
+	}
 	fs.lock.Lock()
 
 	file, ok := fs.open[path]
@@ -486,6 +660,8 @@ func (fs *Dsfs) Write(path string, buff []byte, ofst int64, fh uint64) int {
 	filesize := file.cache.Size()
 	if endofst > filesize {
 		file.cache.Truncate(endofst)
+		// Holes past the end of file are zeros
+		file.load.addRange(filesize, endofst)
 	}
 
 	bytesWrite := file.cache.WriteRange(ofst, endofst, buff)
@@ -517,6 +693,11 @@ func (fs *Dsfs) Release(path string, fh uint64) int {
 		fs.lock.Unlock()
 		return 0
 	}
+	if fs.readOnlyPath(path) {
+		fs.lock.Unlock()
+		zap.S().Warnw("not uploading, volume is read-only", "path", path)
+		return -fuse.EROFS
+	}
 
 	oldTx, overwrite := fs.db.Get(path)
 
@@ -533,95 +714,271 @@ func (fs *Dsfs) Release(path string, fh uint64) int {
 
 	go func() {
 		// Do not attempt to run more than one write job at once for each path
-		if file.syncing.Load() {
+		if !file.syncing.CompareAndSwap(false, true) {
 			return
 		}
 		zap.S().Debugf("uploading %s in the background", path)
-		file.syncing.Store(true)
-		defer file.syncing.Store(false)
-		defer func() { file.dirty = false }()
+		// The file is clean again once the tx is published, or if the
+		// upload failed
+		clean := false
+		markClean := func() {
+			file.lock.Lock()
+			file.dirty = false
+			file.syncing.Store(false)
+			file.lock.Unlock()
+			clean = true
+		}
+		defer func() {
+			if !clean {
+				markClean()
+			}
+		}()
 
-		up := func(idx int, fileID string, checksum string) error {
-			file.lock.RLock()
+		// Parts that were never read have to be present to be chunked
+		err := fs.fetchAll(file)
+		if err != nil {
+			zap.S().Warnw("failed to upload", "path", path, "error", err)
+			return
+		}
+
+		// Unchanged chunks of the previous version are reused even if
+		// they moved within the file
+		oldChunks := make(map[string]int)
+		if overwrite {
+			for i, checksum := range oldTx.Checksums {
+				oldChunks[checksum] = i
+			}
+		}
+
+		// Chunks already stored for other files are deduplicated
+		var dedupChunks, dedupBytes int64
+
+		// Uploads run concurrently and are assembled in chunk order once
+		// all of them completed
+		type upload struct {
+			idxs  []int
+			ref   BlobRef
+			codec Codec
+			err   error
+		}
+		uploads := make(map[string]*upload)
+		var parityUploads []*upload
+		slots := make(chan struct{}, MaxConcurrentUploads)
+		var wg sync.WaitGroup
+		var failed atomic.Bool
+
+		// send uploads data and encodes it with the mount codec if encode
+		// is set
+		send := func(u *upload, data []byte, encode bool) {
+			slots <- struct{}{}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-slots }()
+				codec := RawCodec
+				if encode {
+					data, codec = encodeBlock(data, fs.codec)
+				}
+				u.ref, u.err = fs.writer.SendData(data)
+				u.codec = codec
+				if u.err != nil {
+					failed.Store(true)
+				}
+			}()
+		}
+
+		// Parity is computed from the chunks as they are read so that it
+		// matches the uploaded data
+		var stripe [][]byte
+		var rs *ReedSolomon
+		if fs.erasure != nil {
+			rs, _ = NewReedSolomon(fs.erasure.K, fs.erasure.M)
+			tx.Erasure = fs.erasure
+		}
+		flush := func() {
+			if len(stripe) == 0 {
+				return
+			}
+			k, m := fs.erasure.K, fs.erasure.M
+			first := len(tx.Parity) / m * k
+			defer func() { stripe = nil }()
+
+			// Parity of unchanged stripes is reused
+			if overwrite && oldTx.Erasure != nil && *oldTx.Erasure == *fs.erasure &&
+				len(oldTx.Parity) >= (first/k+1)*m && sameStripe(oldTx, tx, first, k) {
+				for p := first / k * m; p < (first/k+1)*m; p++ {
+					ref := oldTx.ParityRef(p)
+					tx.Parity = append(tx.Parity, ref.ID)
+					tx.ParityMessageIDs = append(tx.ParityMessageIDs, ref.MessageID)
+				}
+				return
+			}
+
+			size := 0
+			for _, chunk := range stripe {
+				if len(chunk) > size {
+					size = len(chunk)
+				}
+			}
+			shards := make([][]byte, k+m)
+			for i := range shards {
+				shards[i] = make([]byte, size)
+				if i < len(stripe) {
+					copy(shards[i], stripe[i])
+				}
+			}
+			rs.Encode(shards)
+			for _, shard := range shards[k:] {
+				u := &upload{idxs: []int{len(tx.Parity)}}
+				tx.Parity = append(tx.Parity, "")
+				tx.ParityMessageIDs = append(tx.ParityMessageIDs, "")
+				parityUploads = append(parityUploads, u)
+				send(u, shard, false)
+			}
+		}
 
-			ofst := int64(idx * FileBlockSize)
+		// up queues the chunk starting at ofst and returns its length
+		up := func(ofst int64) int64 {
+			file.lock.RLock()
 
 			// We need to be very careful about this because we want lock with
 			// quick and correct contention.
 			filesize := file.cache.Size()
-			if ofst > filesize {
+			if ofst >= filesize {
 				file.lock.RUnlock()
-				return nil
+				return 0
 			}
 
-			end := ofst + FileBlockSize
+			end := ofst + MaxChunkSize
 			if end > filesize {
 				end = filesize
 			}
 
 			buffer := make([]byte, end-ofst)
 			file.cache.ReadRange(ofst, end, buffer)
+			file.lock.RUnlock()
+
+			buffer = buffer[:cutChunk(buffer)]
+			length := int64(len(buffer))
 			newChecksum := sha1.Sum(buffer)
 			newChecksumStr := base64.URLEncoding.EncodeToString(newChecksum[:])
 
-			// Checksum valid skipping chunk
-			if checksum == newChecksumStr {
-				tx.Checksums = append(tx.Checksums, checksum)
-				tx.FileIDs = append(tx.FileIDs, fileID)
-				file.lock.RUnlock()
-				return nil
+			idx := len(tx.Checksums)
+			tx.Checksums = append(tx.Checksums, newChecksumStr)
+			tx.Lengths = append(tx.Lengths, length)
+			if fs.erasure != nil {
+				stripe = append(stripe, buffer)
 			}
-			file.lock.RUnlock()
 
-			fileID, err := fs.writer.SendData(buffer)
-			if err != nil {
-				return err
+			// Checksum valid skipping chunk
+			if i, ok := oldChunks[newChecksumStr]; ok && !fs.isLost(oldTx.FileIDs[i]) {
+				ref := oldTx.BlockRef(i)
+				tx.FileIDs = append(tx.FileIDs, ref.ID)
+				tx.MessageIDs = append(tx.MessageIDs, ref.MessageID)
+				tx.Codecs = append(tx.Codecs, oldTx.Codec(i))
+				return length
+			}
+			if ref, ok := fs.volume.blocks.Get(newChecksumStr); ok && !fs.isLost(ref.ID) {
+				tx.FileIDs = append(tx.FileIDs, ref.ID)
+				tx.MessageIDs = append(tx.MessageIDs, ref.MessageID)
+				tx.Codecs = append(tx.Codecs, ref.Codec)
+				dedupChunks++
+				dedupBytes += length
+				return length
 			}
-			tx.Checksums = append(tx.Checksums, newChecksumStr)
-			tx.FileIDs = append(tx.FileIDs, fileID)
-			return nil
-		}
 
-		filesize := file.cache.Size()
-		end := int(filesize / FileBlockSize)
-		if filesize%FileBlockSize != 0 {
-			end++
+			// Filled in once the upload completed
+			tx.FileIDs = append(tx.FileIDs, "")
+			tx.MessageIDs = append(tx.MessageIDs, "")
+			tx.Codecs = append(tx.Codecs, RawCodec)
+			if u, ok := uploads[newChecksumStr]; ok {
+				u.idxs = append(u.idxs, idx)
+				return length
+			}
+			u := &upload{idxs: []int{idx}}
+			uploads[newChecksumStr] = u
+			// Checksums are computed on the decoded block so that
+			// unchanged blocks are skipped regardless of the codec
+			send(u, buffer, true)
+			return length
 		}
 
 		// Dump data selectively based on checksum
 		// or if checksum doesn't exist dump all data
-		if overwrite {
-			for i := 0; i < end; i++ {
-				fileID, checksum := "", ""
-				if i < len(oldTx.Checksums) {
-					fileID, checksum = oldTx.FileIDs[i], oldTx.Checksums[i]
-				}
-				err := up(i, fileID, checksum)
-				if err != nil {
-					return
-				}
+		for ofst := int64(0); ofst < tx.Size && !failed.Load(); {
+			n := up(ofst)
+			if n == 0 {
+				break
 			}
-		} else {
-			tx.Checksums = make([]string, 0, end)
-			for i := 0; i < end; i++ {
-				err := up(i, "", "")
-				if err != nil {
-					return
-				}
+			ofst += n
+			if fs.erasure != nil && len(stripe) == fs.erasure.K {
+				flush()
 			}
 		}
+		if fs.erasure != nil {
+			flush()
+		}
+		wg.Wait()
 
-		b, _ := json.Marshal(tx)
-		if len(b) > MaxDiscordFileSize {
+		for _, u := range uploads {
+			if u.err != nil {
+				zap.S().Warnw("failed to upload", "path", path, "error", u.err)
+				return
+			}
+			for _, idx := range u.idxs {
+				tx.FileIDs[idx] = u.ref.ID
+				tx.MessageIDs[idx] = u.ref.MessageID
+				tx.Codecs[idx] = u.codec
+			}
+		}
+		for _, u := range parityUploads {
+			if u.err != nil {
+				zap.S().Warnw("failed to upload parity", "path", path, "error", u.err)
+				return
+			}
+			tx.Parity[u.idxs[0]] = u.ref.ID
+			tx.ParityMessageIDs[u.idxs[0]] = u.ref.MessageID
+		}
+
+		// Files without encoded blocks keep the original tx format
+		if !tx.encoded() {
+			tx.Codecs = nil
+		}
+		if len(tx.Parity) == 0 {
+			tx.Erasure = nil
+		}
+		// Backends without messages keep the original tx format
+		if !hasMessageIDs(tx.MessageIDs) && !hasMessageIDs(tx.ParityMessageIDs) {
+			tx.MessageIDs = nil
+			tx.ParityMessageIDs = nil
+		}
+		b := encodeTx(*tx)
+		if len(b) > MaxDiscordFileSize-fs.volume.TxOverhead() {
+			zap.S().Warnw("not uploading, tx is too large", "path", path, "size", len(b))
 			return
 		}
-		_, err := fs.writer.SendTx(b)
+		markClean()
+		messageID, err := fs.writer.SendTx(b)
 		if err != nil {
+			// The file is uploaded again on its next release
+			zap.S().Warnw("failed to send tx", "path", path, "error", err)
+			file.lock.Lock()
+			file.dirty = true
+			file.lock.Unlock()
 			return
 		}
 		fs.lock.Lock()
+		current, _ := fs.db.Get(path)
 		fs.db.Insert(path, tx)
+		fs.db.SetMessage(path, messageID)
+		delete(fs.degraded, path)
+		fs.volume.applied(messageID)
 		fs.lock.Unlock()
+		fs.volume.supersede(current, tx)
+		fs.logTx(messageID, b)
+		if dedupChunks > 0 {
+			zap.S().Infow("deduplicated blocks", "path", path, "blocks", dedupChunks, "bytes", dedupBytes)
+		}
 		zap.S().Debugw("Release done", "path", path)
 	}()
 
@@ -647,6 +1004,10 @@ func (fs *Dsfs) Readdir(
 	fs.lock.Lock()
 	defer fs.lock.Unlock()
 
+	if isVirtual(path) {
+		return fs.readdirVirtual(path, fill)
+	}
+
 	fill(".", &fuse.Stat_t{Mode: fuse.S_IFDIR | 0o777}, 0)
 	fill("..", nil, 0)
 	it := fs.db.Iterator(path)
@@ -703,43 +1064,85 @@ func (fs *Dsfs) Statfs(path string, stat *fuse.Statfs_t) int {
 	return 0
 }
 
-func (fs *Dsfs) ApplyLiveTx(path string, tx *Tx) error {
-	zap.S().Debugw("ApplyLiveTx", "tx.Path", tx.Path)
+// ApplyLiveTxs applies the tx batch of a remote client stored in message
+// messageID
+// The tree changes under a single lock so that the batch is seen as a
+// whole. Open files are patched afterwards.
+func (fs *Dsfs) ApplyLiveTxs(txs []*Tx, messageID string) error {
+	type patch struct {
+		file *FileData
+		tx   *Tx
+	}
+	var patches []patch
 	fs.lock.Lock()
-
-	fs.db.Insert(path, tx)
-	file, ok := fs.open[tx.Path]
-	if !ok {
-		fs.lock.Unlock()
-		return nil
+	for _, tx := range txs {
+		zap.S().Debugw("ApplyLiveTxs", "tx.Path", tx.Path, "tx.Tx", tx.Tx)
+		old, _ := fs.db.Get(tx.Path)
+		switch tx.Tx {
+		case WriteTx:
+			fs.db.Insert(tx.Path, tx)
+			fs.db.SetMessage(tx.Path, messageID)
+			fs.volume.supersede(old, tx)
+			if file, ok := fs.open[tx.Path]; ok {
+				patches = append(patches, patch{file, tx})
+			}
+		case DeleteTx:
+			fs.db.Delete(tx.Path)
+			delete(fs.open, tx.Path)
+			fs.volume.supersede(old, nil)
+		}
 	}
+	fs.volume.applied(messageID)
 	fs.lock.Unlock()
 
+	var err error
+	for _, p := range patches {
+		if perr := fs.patchFile(p.file, p.tx); perr != nil && err == nil {
+			err = perr
+		}
+	}
+	return err
+}
+
+// patchFile updates an open file to a tx of a remote client
+func (fs *Dsfs) patchFile(file *FileData, tx *Tx) error {
 	file.lock.Lock()
 	filesize := file.cache.Size()
 	if tx.Size < filesize {
 		file.load.truncate(tx.Size)
 	}
 	file.cache.Truncate(tx.Size)
+	// Blocks that are not loaded yet are fetched from the new version
+	offsets := tx.Offsets()
+	file.tx = tx
+	file.offsets = offsets
+	file.fetches = make(map[int]*blockFetch)
 	file.lock.Unlock()
 
-	buffer := make([]byte, FileBlockSize)
+	// Changed blocks are patched in parallel
+	var wg sync.WaitGroup
+	errs := make(chan error, len(tx.Checksums)+1)
 	for idx, checksum := range tx.Checksums {
 		file.lock.Lock()
-		ofst := int64(idx * FileBlockSize)
+		ofst := offsets[idx]
 		// Something can happen between truncating and patching memory.
 		// In this case it's really hard to recover.
 		filesize = file.cache.Size()
 		if ofst >= filesize {
 			file.lock.Unlock()
-			return errors.New("file changed while upcoming change is applied")
+			errs <- errors.New("file changed while upcoming change is applied")
+			break
 		}
-		end := ofst + FileBlockSize
+		end := offsets[idx+1]
 		if end > filesize {
 			end = filesize
 		}
+		if !file.load.overlaps(ofst, end) {
+			file.lock.Unlock()
+			continue
+		}
 
-		buffer = make([]byte, end-ofst)
+		buffer := make([]byte, end-ofst)
 		file.cache.ReadRange(ofst, end, buffer)
 		oldChecksum := sha1.Sum(buffer)
 		oldChecksumStr := base64.URLEncoding.EncodeToString(oldChecksum[:])
@@ -749,21 +1152,29 @@ func (fs *Dsfs) ApplyLiveTx(path string, tx *Tx) error {
 			continue
 		}
 
-		n, err := getDataFile(fs.dataChannel.ID, tx.FileIDs[idx], buffer)
-		if err != nil {
-			return err
-		}
+		idx := idx
+		wg.Add(1)
+		fs.downloads.Submit(ReadPriority, func() {
+			defer wg.Done()
+			n, err := fs.getBlock(tx, idx, buffer)
+			if err != nil {
+				errs <- err
+				return
+			}
 
-		file.lock.Lock()
-		ofstn := ofst + int64(n)
-		file.cache.WriteRange(ofst, ofstn, buffer)
-		if !file.load.isReady(ofst, ofstn) {
-			file.load.addRange(ofst, ofstn)
-		}
-		file.lock.Unlock()
+			file.lock.Lock()
+			ofstn := ofst + int64(n)
+			file.cache.WriteRange(ofst, ofstn, buffer)
+			if !file.load.isReady(ofst, ofstn) {
+				file.load.addRange(ofst, ofstn)
+			}
+			file.lock.Unlock()
+		})
 	}
+	wg.Wait()
+	close(errs)
 
-	return nil
+	return <-errs
 }
 
 func (fs *Dsfs) GetNewCache() Cache {
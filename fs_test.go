@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/darenliang/dsfs/fuse"
+)
+
+// newTestDsfs mounts a new volume on backend without FUSE
+func newTestDsfs(t *testing.T, backend Backend) *Dsfs {
+	t.Helper()
+	volume := NewVolume("", false)
+	db, err := setupDB(backend, volume, false, "map")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := NewDsfs(backend, volume, db, setupWriter(backend), NewScheduler(4), "memory", RawCodec, nil)
+	fs.leaser = NewLeaser(backend)
+	return fs
+}
+
+// newTestLocalBackend creates a local backend in dir
+func newTestLocalBackend(t *testing.T, dir string) *LocalBackend {
+	t.Helper()
+	backend, err := NewLocalBackend(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return backend
+}
+
+// countingBackend counts downloaded blocks
+type countingBackend struct {
+	Backend
+	gets atomic.Int64
+}
+
+func (b *countingBackend) GetBlob(ref BlobRef, buffer []byte) (int, error) {
+	b.gets.Add(1)
+	return b.Backend.GetBlob(ref, buffer)
+}
+
+// putFile stores data as path directly through backend
+func putFile(t *testing.T, backend Backend, path string, data []byte) *Tx {
+	t.Helper()
+	tx := &Tx{Tx: WriteTx, Path: path, Type: FileType, Size: int64(len(data))}
+	for rest := data; len(rest) > 0; {
+		chunk := rest[:cutChunk(rest)]
+		rest = rest[len(chunk):]
+		refs, err := backend.PutBlobs([][]byte{chunk})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum := sha1.Sum(chunk)
+		tx.FileIDs = append(tx.FileIDs, refs[0].ID)
+		tx.Checksums = append(tx.Checksums, base64.URLEncoding.EncodeToString(sum[:]))
+		tx.Lengths = append(tx.Lengths, int64(len(chunk)))
+	}
+	b, _ := json.Marshal(tx)
+	if _, err := backend.AppendTxs([][]byte{b}); err != nil {
+		t.Fatal(err)
+	}
+	return tx
+}
+
+// writeFile creates path with data and waits until it is released
+func writeFile(t *testing.T, fs *Dsfs, path string, data []byte) *Tx {
+	t.Helper()
+	if errc := fs.Mknod(path, 0, 0); errc != 0 {
+		t.Fatalf("Mknod %s, %d", path, errc)
+	}
+	if n := fs.Write(path, data, 0, 0); n != len(data) {
+		t.Fatalf("Write %s, %d", path, n)
+	}
+	fs.Release(path, 0)
+	var tx *Tx
+	waitFor(t, "release of "+path, func() bool {
+		fs.lock.Lock()
+		defer fs.lock.Unlock()
+		tx, _ = fs.db.Get(path)
+		return tx != nil
+	})
+	return tx
+}
+
+// readFile opens path and reads it completely
+func readFile(t *testing.T, fs *Dsfs, path string, size int) []byte {
+	t.Helper()
+	if errc, _ := fs.Open(path, 0); errc != 0 {
+		t.Fatalf("Open %s, %d", path, errc)
+	}
+	data := make([]byte, size)
+	for ofst := 0; ofst < size; {
+		n := fs.Read(path, data[ofst:], int64(ofst), 0)
+		if n <= 0 {
+			t.Fatalf("Read %s at %d, %d", path, ofst, n)
+		}
+		ofst += n
+	}
+	return data
+}
+
+func TestReleaseDedup(t *testing.T) {
+	dir := t.TempDir()
+	fs := newTestDsfs(t, newTestLocalBackend(t, dir))
+
+	data := make([]byte, 3<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	a := writeFile(t, fs, "/a", data)
+	b := writeFile(t, fs, "/b", data)
+	if len(a.FileIDs) == 0 || a.FileIDs[0] != b.FileIDs[0] {
+		t.Errorf("copy was not deduplicated, %v and %v", a.FileIDs, b.FileIDs)
+	}
+	entries, _ := os.ReadDir(filepath.Join(dir, DataChannelName))
+	if len(entries) != len(a.FileIDs) {
+		t.Errorf("expected %d stored blocks, got %d", len(a.FileIDs), len(entries))
+	}
+
+	// The index is rebuilt when the tx log is replayed
+	fs = newTestDsfs(t, newTestLocalBackend(t, dir))
+	if _, ok := fs.volume.blocks.Get(a.Checksums[0]); !ok {
+		t.Error("block is missing from the replayed index")
+	}
+	if got := readFile(t, fs, "/b", len(data)); !bytes.Equal(got, data) {
+		t.Error("deduplicated file does not match")
+	}
+}
+
+func TestReadOnDemand(t *testing.T) {
+	dir := t.TempDir()
+	backend := &countingBackend{Backend: newTestLocalBackend(t, dir)}
+	fs := newTestDsfs(t, backend)
+
+	data := make([]byte, 48<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	tx := putFile(t, backend, "/big", data)
+	if len(tx.FileIDs) <= ReadAheadBlocks+1 {
+		t.Fatalf("expected more than %d blocks, got %d", ReadAheadBlocks+1, len(tx.FileIDs))
+	}
+	fs = newTestDsfs(t, backend)
+
+	if errc, _ := fs.Open("/big", 0); errc != 0 {
+		t.Fatalf("Open, %d", errc)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := backend.gets.Load(); n != 0 {
+		t.Errorf("Open fetched %d blocks", n)
+	}
+
+	header := make([]byte, 512)
+	if n := fs.Read("/big", header, 0, 0); n != len(header) || !bytes.Equal(header, data[:512]) {
+		t.Fatalf("Read header, %d", n)
+	}
+	waitFor(t, "read-ahead", func() bool { return backend.gets.Load() == 1+ReadAheadBlocks })
+
+	// Reads spanning blocks in the middle of the file
+	ofst := tx.Offsets()[len(tx.FileIDs)/2] - 100
+	buff := make([]byte, 200)
+	if n := fs.Read("/big", buff, ofst, 0); n != len(buff) || !bytes.Equal(buff, data[ofst:ofst+200]) {
+		t.Fatalf("Read middle, %d", n)
+	}
+	if n := backend.gets.Load(); n >= int64(len(tx.FileIDs)) {
+		t.Errorf("expected a partial download, fetched %d of %d blocks", n, len(tx.FileIDs))
+	}
+
+	// Releasing a partially loaded file keeps the blocks that were never read
+	fs.Write("/big", []byte("edited"), 0, 0)
+	copy(data, "edited")
+	fs.Release("/big", 0)
+	waitFor(t, "release", func() bool {
+		fs.lock.Lock()
+		defer fs.lock.Unlock()
+		got, _ := fs.db.Get("/big")
+		return got.Checksums[0] != tx.Checksums[0]
+	})
+	fs = newTestDsfs(t, backend)
+	if got := readFile(t, fs, "/big", len(data)); !bytes.Equal(got, data) {
+		t.Error("file does not match after release")
+	}
+}
+
+func TestReleaseParallel(t *testing.T) {
+	dir := t.TempDir()
+	fs := newTestDsfs(t, newTestLocalBackend(t, dir))
+
+	data := make([]byte, 48<<20)
+	rand.New(rand.NewSource(2)).Read(data)
+	start := time.Now()
+	tx := writeFile(t, fs, "/big", data)
+	// Sequential uploads wait up to QueueTimeout for every chunk
+	if elapsed := time.Since(start); elapsed > time.Duration(len(tx.FileIDs)/2)*QueueTimeout {
+		t.Errorf("uploading %d chunks took %s", len(tx.FileIDs), elapsed)
+	}
+
+	offsets := tx.Offsets()
+	if offsets[len(offsets)-1] != int64(len(data)) {
+		t.Fatalf("chunks cover %d bytes, want %d", offsets[len(offsets)-1], len(data))
+	}
+	fs = newTestDsfs(t, newTestLocalBackend(t, dir))
+	if got := readFile(t, fs, "/big", len(data)); !bytes.Equal(got, data) {
+		t.Error("file does not match after parallel upload")
+	}
+}
+
+func TestReadCorruptBlock(t *testing.T) {
+	dir := t.TempDir()
+	backend := &countingBackend{Backend: newTestLocalBackend(t, dir)}
+	fs := newTestDsfs(t, backend)
+
+	data := bytes.Repeat([]byte("data"), 1000)
+	tx := putFile(t, backend, "/file", data)
+	name := filepath.Join(dir, DataChannelName, tx.FileIDs[0])
+	stored, _ := os.ReadFile(name)
+	stored[0] ^= 1
+	if err := os.WriteFile(name, stored, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	fs = newTestDsfs(t, backend)
+	if errc, _ := fs.Open("/file", 0); errc != 0 {
+		t.Fatalf("Open, %d", errc)
+	}
+	if n := fs.Read("/file", make([]byte, 100), 0, 0); n != -fuse.EIO {
+		t.Errorf("expected EIO for a corrupt block, got %d", n)
+	}
+	if n := backend.gets.Load(); n != BlockRetries {
+		t.Errorf("expected %d attempts, got %d", BlockRetries, n)
+	}
+}
+
+func TestRenameFolder(t *testing.T) {
+	dir := t.TempDir()
+	backend := newTestLocalBackend(t, dir)
+	fs := newTestDsfs(t, backend)
+
+	for _, path := range []string{"/a", "/a/b", "/ab", "/empty"} {
+		if errc := fs.Mkdir(path, 0); errc != 0 {
+			t.Fatalf("Mkdir %s, %d", path, errc)
+		}
+	}
+	data := []byte("nested")
+	writeFile(t, fs, "/a/b/f", data)
+	writeFile(t, fs, "/a/g", data)
+	// Files that were never released are moved in memory
+	if errc := fs.Mknod("/a/open", 0, 0); errc != 0 {
+		t.Fatalf("Mknod, %d", errc)
+	}
+	fs.Write("/a/open", data, 0, 0)
+
+	for _, c := range []struct {
+		oldpath, newpath string
+		errc             int
+	}{
+		{"/a", "/a/b/c", -fuse.EINVAL},
+		{"/a", "/ab/x/y", -fuse.ENOENT},
+		{"/ab", "/a", -fuse.ENOTEMPTY},
+		{"/ab", "/a/g", -fuse.ENOTDIR},
+		{"/a/g", "/a/b", -fuse.EISDIR},
+	} {
+		if errc := fs.Rename(c.oldpath, c.newpath); errc != c.errc {
+			t.Errorf("Rename %s to %s returned %d, want %d", c.oldpath, c.newpath, errc, c.errc)
+		}
+	}
+
+	// A remote client applies the rename as a live batch
+	remote := newTestDsfs(t, backend)
+	records, _ := backend.ListTxs()
+	sent := fs.volume.logTxs.Load()
+	fs.lock.Lock()
+	shared, _ := fs.db.Get("/a/g")
+	fs.lock.Unlock()
+	if errc := fs.Rename("/a", "/empty"); errc != 0 {
+		t.Fatalf("Rename, %d", errc)
+	}
+	check := func(fs *Dsfs) {
+		t.Helper()
+		fs.lock.Lock()
+		defer fs.lock.Unlock()
+		for path, exists := range map[string]bool{
+			"/a": false, "/a/b": false, "/a/b/f": false, "/a/g": false,
+			"/ab": true, "/empty": true, "/empty/b": true, "/empty/b/f": true, "/empty/g": true,
+		} {
+			if tx, ok := fs.db.Get(path); ok != exists || ok && tx.Path != path {
+				t.Errorf("path %s exists = %v, want %v", path, ok, exists)
+			}
+		}
+	}
+	check(fs)
+	fs.lock.Lock()
+	_, moved := fs.open["/empty/open"]
+	fs.lock.Unlock()
+	if !moved {
+		t.Error("open file was not moved")
+	}
+	if shared.Path != "/a/g" {
+		t.Errorf("rename changed the path of the previous tx to %s", shared.Path)
+	}
+	// Four writes and four deletes
+	waitForTxs(t, fs, sent, 8)
+	after, _ := backend.ListTxs()
+	if len(after) != len(records)+1 {
+		t.Fatalf("rename sent %d tx batches, want 1", len(after)-len(records))
+	}
+	if err := applyMessageTxs(remote.db, remote.volume, after[len(records):], nil, remote); err != nil {
+		t.Fatal(err)
+	}
+	check(remote)
+
+	fs = newTestDsfs(t, newTestLocalBackend(t, dir))
+	check(fs)
+	if got := readFile(t, fs, "/empty/b/f", len(data)); !bytes.Equal(got, data) {
+		t.Errorf("moved file reads %q, want %q", got, data)
+	}
+}
+
+func TestReleaseSendFailed(t *testing.T) {
+	backend := newTestLocalBackend(t, t.TempDir())
+	fs := newTestDsfs(t, backend)
+	failing := &failingBackend{Backend: backend}
+	fs.writer = setupWriter(failing)
+
+	data := []byte("contents")
+	if errc := fs.Mknod("/a", 0, 0); errc != 0 {
+		t.Fatalf("Mknod, %d", errc)
+	}
+	if n := fs.Write("/a", data, 0, 0); n != len(data) {
+		t.Fatalf("Write, %d", n)
+	}
+	fs.Release("/a", 0)
+	waitFor(t, "tx of /a", func() bool { return failing.appends.Load() == 1 })
+	fs.lock.Lock()
+	file := fs.open["/a"]
+	fs.lock.Unlock()
+	waitFor(t, "/a to be dirty again", func() bool {
+		file.lock.RLock()
+		defer file.lock.RUnlock()
+		return file.dirty && !file.syncing.Load()
+	})
+
+	// The next release uploads the file again
+	fs.writer = setupWriter(backend)
+	fs.Release("/a", 0)
+	waitFor(t, "release of /a", func() bool {
+		fs.lock.Lock()
+		defer fs.lock.Unlock()
+		_, ok := fs.db.Get("/a")
+		return ok
+	})
+}
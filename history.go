@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// ReplayPoint is the last tx batch replayed by a point-in-time mount
+// Either the ID of the last batch or the time of the last batch is set.
+type ReplayPoint struct {
+	ID   string
+	Time time.Time
+}
+
+// parseReplayPoint parses a tx message ID or a timestamp
+// Timestamps are RFC 3339 times, or dates in local time.
+func parseReplayPoint(s string) (ReplayPoint, error) {
+	if _, err := strconv.ParseUint(s, 10, 64); err == nil {
+		return ReplayPoint{ID: s}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return ReplayPoint{Time: t}, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return ReplayPoint{Time: t}, nil
+	}
+	return ReplayPoint{}, fmt.Errorf("%q is neither a message ID nor a timestamp", s)
+}
+
+// includes reports whether a tx batch was appended before the point
+func (p ReplayPoint) includes(record TxRecord) bool {
+	if p.ID != "" {
+		return !txIDLess(p.ID, record.ID)
+	}
+	return !record.Time.After(p.Time)
+}
+
+func (p ReplayPoint) String() string {
+	if p.ID != "" {
+		return p.ID
+	}
+	return p.Time.Format(time.RFC3339)
+}
+
+// pointInTimeBackend lists the tx log as it was at a point
+// The log before the pinned checkpoint is read if the point precedes it,
+// since compaction only restates the tree. It cannot be written to.
+type pointInTimeBackend struct {
+	Backend
+	at ReplayPoint
+}
+
+// ListTxs lists the tx batches appended up to the point
+func (b *pointInTimeBackend) ListTxs() ([]TxRecord, error) {
+	records, err := b.Backend.ListTxs()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) != 0 && !b.at.includes(records[0]) {
+		tail, ok := b.Backend.(TxTailer)
+		if !ok {
+			return nil, fmt.Errorf("%s precedes the pinned checkpoint", b.at)
+		}
+		// Every batch follows the first message ID
+		if records, err = tail.ListTxsAfter("0"); err != nil {
+			return nil, err
+		}
+	}
+	for i, record := range records {
+		if !b.at.includes(record) {
+			records = records[:i]
+			break
+		}
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("the volume did not exist at %s", b.at)
+	}
+	return records, nil
+}
+
+var errPointInTime = errors.New("point-in-time mounts are read-only")
+
+func (b *pointInTimeBackend) PutBlobs([][]byte) ([]BlobRef, error) {
+	return nil, errPointInTime
+}
+
+func (b *pointInTimeBackend) AppendTxs([][]byte) ([]string, error) {
+	return nil, errPointInTime
+}
+
+func (b *pointInTimeBackend) PinCheckpoint(string) error {
+	return errPointInTime
+}
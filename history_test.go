@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/darenliang/dsfs/fuse"
+)
+
+func TestParseReplayPoint(t *testing.T) {
+	for s, want := range map[string]ReplayPoint{
+		"1094011617894268929":  {ID: "1094011617894268929"},
+		"2024-05-01T10:00:00Z": {Time: time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)},
+		"2024-05-01":           {Time: time.Date(2024, 5, 1, 0, 0, 0, 0, time.Local)},
+	} {
+		got, err := parseReplayPoint(s)
+		if err != nil {
+			t.Errorf("%s, %v", s, err)
+			continue
+		}
+		if got.ID != want.ID || !got.Time.Equal(want.Time) {
+			t.Errorf("%s parsed as %+v, want %+v", s, got, want)
+		}
+	}
+	if _, err := parseReplayPoint("yesterday"); err == nil {
+		t.Error("parsed an invalid point")
+	}
+}
+
+func TestPointInTimeMount(t *testing.T) {
+	backend := newTestLocalBackend(t, t.TempDir())
+	if _, err := setupDB(backend, NewVolume("", false), false, "map"); err != nil {
+		t.Fatal(err)
+	}
+	lastID := func() string {
+		t.Helper()
+		records, err := backend.ListTxs()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return records[len(records)-1].ID
+	}
+	putFile(t, backend, "/f", []byte("old"))
+	if _, err := backend.AppendTxs([][]byte{encodeTx(Tx{Tx: WriteTx, Path: "/dir", Type: FolderType})}); err != nil {
+		t.Fatal(err)
+	}
+	point := ReplayPoint{ID: lastID()}
+	putFile(t, backend, "/f", []byte("new"))
+	if _, err := backend.AppendTxs([][]byte{encodeTx(createDeleteTx("/dir"))}); err != nil {
+		t.Fatal(err)
+	}
+	// Compaction drops the history from the pinned log
+	if _, err := setupDB(backend, NewVolume("", false), true, "map"); err != nil {
+		t.Fatal(err)
+	}
+
+	at := &pointInTimeBackend{Backend: backend, at: point}
+	fs := newTestDsfs(t, at)
+	fs.readOnly.Store(true)
+	if _, ok := fs.db.Get("/dir"); !ok {
+		t.Error("deleted folder is missing at the point")
+	}
+	if got := readFile(t, fs, "/f", 3); !bytes.Equal(got, []byte("old")) {
+		t.Errorf("got %q at the point, want %q", got, "old")
+	}
+	if code := fs.Mkdir("/other", 0); code != -fuse.EROFS {
+		t.Errorf("mkdir returned %d, want %d", code, -fuse.EROFS)
+	}
+
+	// Timestamps select the batches appended up to them
+	records, err := at.ListTxs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	byTime := &pointInTimeBackend{Backend: backend, at: ReplayPoint{Time: records[len(records)-1].Time}}
+	timed, err := byTime.ListTxs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(timed) != len(records) {
+		t.Errorf("got %d batches up to the time, want %d", len(timed), len(records))
+	}
+	if _, err := (&pointInTimeBackend{Backend: backend, at: ReplayPoint{ID: "1"}}).ListTxs(); err == nil {
+		t.Error("listed the log before the volume existed")
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Lease settings
+const (
+	// LeaseTTL is how long a lease is valid after it was claimed or renewed
+	LeaseTTL = 30 * time.Second
+	// LeaseRenewInterval is how often a held lease is renewed
+	LeaseRenewInterval = 10 * time.Second
+	// LeaseHistory is how far back lease messages are read
+	// Claims older than LeaseTTL have expired, the rest of the history is
+	// needed to tell which of them were accepted.
+	LeaseHistory = 3 * LeaseTTL
+)
+
+// ErrLeaseHeld is returned when the lease of a volume is held by another
+// client
+var ErrLeaseHeld = errors.New("volume lease is held by another client")
+
+// LeaseLog is implemented by backends that can store lease messages next to
+// the tx log
+type LeaseLog interface {
+	// AppendLease appends a lease message and returns its ID
+	AppendLease(data []byte) (string, error)
+	// DeleteLease deletes a lease message
+	DeleteLease(id string) error
+	// ListLeases lists the lease messages sent since a time in the order
+	// they were sent
+	ListLeases(since time.Time) ([]LeaseRecord, error)
+}
+
+// LeaseRecord is a lease message stored in a Backend
+// Time is assigned by the backend when the message is stored.
+type LeaseRecord struct {
+	ID   string
+	Time time.Time
+	Data []byte
+}
+
+// Lease is a claim of a volume by a client
+//
+// Lease messages are ordered by the backend. A claim is accepted if the
+// accepted lease before it expired or belongs to the same holder, so every
+// client agrees on the holder without a compare-and-swap. Renewals are
+// claims of the holder, and a claim with a zero TTL releases the lease.
+//
+// A client deletes its previous message once its next claim is accepted
+// right after it. That never changes the accepted lease, so renewals do not
+// pile up in the backend.
+type Lease struct {
+	Holder string `json:"holder"`
+	// TTL is in milliseconds
+	TTL int64 `json:"ttl"`
+	// Exclusive leases make other clients mount read-only
+	Exclusive bool `json:"exclusive,omitempty"`
+	// Expiry is derived from the time of the message
+	Expiry time.Time `json:"-"`
+}
+
+// acceptedLease replays lease messages and returns the last accepted lease
+// The lease may have expired already.
+func acceptedLease(records []LeaseRecord) *Lease {
+	var accepted *Lease
+	for _, record := range records {
+		lease := &Lease{}
+		if err := json.Unmarshal(record.Data, lease); err != nil || lease.Holder == "" {
+			zap.S().Debugw("skipping invalid lease message", "id", record.ID)
+			continue
+		}
+		lease.Expiry = record.Time.Add(time.Duration(lease.TTL) * time.Millisecond)
+		if accepted == nil || !record.Time.Before(accepted.Expiry) || lease.Holder == accepted.Holder {
+			accepted = lease
+		}
+	}
+	return accepted
+}
+
+// newHolderID creates an ID for the leases of this client
+func newHolderID() string {
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(b))
+}
+
+// Leaser acquires and renews the lease of a volume for this client
+// Acquisitions are counted so that the lease is released when the last user
+// releases it.
+type Leaser struct {
+	log    LeaseLog
+	holder string
+	// lease is the last confirmed lease of this client
+	lease *Lease
+	// sent is the ID of the last lease message of this client
+	sent  string
+	users int
+	stop  chan struct{}
+	lock  sync.Mutex
+}
+
+// NewLeaser creates a new Leaser for the leases stored in backend
+func NewLeaser(backend Backend) *Leaser {
+	log, _ := backend.(LeaseLog)
+	return &Leaser{log: log, holder: newHolderID()}
+}
+
+// Current returns the lease of the volume, or nil if no lease is held
+func (l *Leaser) Current() (*Lease, error) {
+	if l.log == nil {
+		return nil, errors.New("backend does not support leases")
+	}
+	records, err := l.log.ListLeases(time.Now().Add(-LeaseHistory))
+	if err != nil {
+		return nil, err
+	}
+	lease := acceptedLease(records)
+	if lease == nil || !lease.Expiry.After(time.Now()) {
+		return nil, nil
+	}
+	return lease, nil
+}
+
+// HeldByOther reports whether another client holds an exclusive lease
+func (l *Leaser) HeldByOther() (bool, error) {
+	lease, err := l.Current()
+	if err != nil {
+		return false, err
+	}
+	return lease != nil && lease.Exclusive && lease.Holder != l.holder, nil
+}
+
+// Acquire claims the lease of the volume and renews it until it is released
+// Acquiring a lease this client already holds only counts another user.
+func (l *Leaser) Acquire(exclusive bool) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.users > 0 {
+		if l.lease == nil {
+			return fmt.Errorf("%w, the lease of this client was lost", ErrLeaseHeld)
+		}
+		l.users++
+		return nil
+	}
+
+	current, err := l.Current()
+	if err != nil {
+		return err
+	}
+	if current != nil && current.Holder != l.holder {
+		return fmt.Errorf("%w, %s holds it until %s", ErrLeaseHeld, current.Holder, current.Expiry.Format(time.RFC3339))
+	}
+	if err := l.claim(LeaseTTL, exclusive); err != nil {
+		return err
+	}
+	if l.lease == nil {
+		return ErrLeaseHeld
+	}
+
+	l.users = 1
+	l.stop = make(chan struct{})
+	go l.renew(l.stop, exclusive)
+	zap.S().Infow("acquired volume lease", "holder", l.holder, "exclusive", exclusive)
+	return nil
+}
+
+// claim appends a lease message and confirms that it was accepted
+// l.lease is cleared if another client holds the lease.
+func (l *Leaser) claim(ttl time.Duration, exclusive bool) error {
+	b, _ := json.Marshal(Lease{Holder: l.holder, TTL: ttl.Milliseconds(), Exclusive: exclusive})
+	id, err := l.log.AppendLease(b)
+	if err != nil {
+		return err
+	}
+	previous := l.sent
+	l.sent = id
+	records, err := l.log.ListLeases(time.Now().Add(-LeaseHistory))
+	if err != nil {
+		return err
+	}
+	lease := acceptedLease(records)
+	if lease == nil || lease.Holder != l.holder {
+		l.lease = nil
+		return nil
+	}
+	l.lease = lease
+	l.prune(records, previous, id)
+	return nil
+}
+
+// prune deletes the previous lease message of this client if the accepted
+// message id directly follows it
+// Either the previous message was rejected or the accepted lease before it
+// would accept id too, so the accepted lease stays the same.
+func (l *Leaser) prune(records []LeaseRecord, previous string, id string) {
+	for i := 1; i < len(records); i++ {
+		if records[i].ID != id {
+			continue
+		}
+		if records[i-1].ID == previous {
+			if err := l.log.DeleteLease(previous); err != nil {
+				zap.S().Warnw("failed to delete previous lease message", "id", previous, "error", err)
+			}
+		}
+		return
+	}
+}
+
+// renew renews the lease until stop is closed or the lease is lost
+func (l *Leaser) renew(stop chan struct{}, exclusive bool) {
+	ticker := time.NewTicker(LeaseRenewInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		l.lock.Lock()
+		if l.stop != stop {
+			l.lock.Unlock()
+			return
+		}
+		err := l.claim(LeaseTTL, exclusive)
+		lost := l.lease == nil
+		l.lock.Unlock()
+		if err != nil {
+			zap.S().Warnw("failed to renew volume lease", "error", err)
+			continue
+		}
+		if lost {
+			zap.S().Errorw("lost volume lease, exclusive mounts are read-only", "holder", l.holder)
+			return
+		}
+	}
+}
+
+// Held reports whether this client holds an unexpired lease
+func (l *Leaser) Held() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.lease != nil && l.lease.Expiry.After(time.Now())
+}
+
+// Release releases the lease once every user released it
+func (l *Leaser) Release() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.users == 0 {
+		return
+	}
+	if l.users--; l.users > 0 {
+		return
+	}
+	close(l.stop)
+	l.stop = nil
+	if l.lease == nil {
+		return
+	}
+	if err := l.claim(0, false); err != nil {
+		zap.S().Warnw("failed to release volume lease", "error", err)
+	}
+	l.lease = nil
+	zap.S().Infow("released volume lease", "holder", l.holder)
+}
+
+// sortLeases sorts lease messages in the order they were sent
+func sortLeases(records []LeaseRecord) {
+	sort.SliceStable(records, func(i, j int) bool {
+		return txIDLess(records[i].ID, records[j].ID)
+	})
+}
+
+// watchLease mounts the volume read-only while another client holds an
+// exclusive lease
+func (fs *Dsfs) watchLease(interval time.Duration) {
+	for {
+		held, err := fs.leaser.HeldByOther()
+		if err != nil {
+			zap.S().Warnw("failed to read volume lease", "error", err)
+		} else if fs.readOnly.Swap(held) != held {
+			if held {
+				zap.S().Warn("another client holds an exclusive lease, volume is read-only")
+			} else {
+				zap.S().Info("exclusive lease was released, volume is writable")
+			}
+		}
+		time.Sleep(interval)
+	}
+}
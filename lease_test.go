@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/darenliang/dsfs/fuse"
+)
+
+func TestAcceptedLease(t *testing.T) {
+	start := time.Now()
+	record := func(id string, offset time.Duration, lease Lease) LeaseRecord {
+		b, _ := json.Marshal(lease)
+		return LeaseRecord{ID: id, Time: start.Add(offset), Data: b}
+	}
+	ttl := LeaseTTL.Milliseconds()
+	records := []LeaseRecord{
+		record("1", 0, Lease{Holder: "a", TTL: ttl}),
+		// Claims of other holders are rejected until the lease expires
+		record("2", LeaseTTL/2, Lease{Holder: "b", TTL: ttl}),
+		record("3", LeaseTTL, Lease{Holder: "b", TTL: ttl}),
+		{ID: "4", Time: start.Add(LeaseTTL), Data: []byte("invalid")},
+		record("5", 2*LeaseTTL, Lease{Holder: "b", TTL: ttl, Exclusive: true}),
+	}
+	for n, want := range map[int]string{1: "a", 2: "a", 3: "b", 4: "b", 5: "b"} {
+		lease := acceptedLease(records[:n])
+		if lease == nil || lease.Holder != want {
+			t.Errorf("after %d messages got lease %+v, want holder %s", n, lease, want)
+		}
+	}
+
+	// Renewals extend the lease of the holder
+	lease := acceptedLease(records)
+	if want := start.Add(3 * LeaseTTL); !lease.Expiry.Equal(want) || !lease.Exclusive {
+		t.Errorf("got lease %+v, want an exclusive lease until %s", lease, want)
+	}
+	released := append(records, record("6", 2*LeaseTTL, Lease{Holder: "b"}))
+	if lease := acceptedLease(released); lease.Expiry.After(start.Add(2 * LeaseTTL)) {
+		t.Errorf("released lease expires at %s", lease.Expiry)
+	}
+}
+
+func TestLeaser(t *testing.T) {
+	backend := newTestLocalBackend(t, t.TempDir())
+	a, b := NewLeaser(backend), NewLeaser(backend)
+
+	if err := a.Acquire(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Acquire(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Acquire(false); !errors.Is(err, ErrLeaseHeld) {
+		t.Fatalf("got error %v, want %v", err, ErrLeaseHeld)
+	}
+	if held, err := b.HeldByOther(); err != nil || !held {
+		t.Errorf("held by other = %v, %v, want true", held, err)
+	}
+	if held, err := a.HeldByOther(); err != nil || held {
+		t.Errorf("held by other = %v, %v for the holder, want false", held, err)
+	}
+	renewLease(t, a, backend)
+
+	// The lease is released once every user released it
+	a.Release()
+	if !a.Held() {
+		t.Fatal("lease was released while in use")
+	}
+	a.Release()
+	if a.Held() {
+		t.Fatal("lease is still held after release")
+	}
+	if err := b.Acquire(false); err != nil {
+		t.Fatal(err)
+	}
+	if held, err := a.HeldByOther(); err != nil || held {
+		t.Errorf("held by other = %v, %v for a shared lease, want false", held, err)
+	}
+	b.Release()
+}
+
+// renewLease renews the lease of l a few times and checks that the renewals
+// replace each other in the lease log
+func renewLease(t *testing.T, l *Leaser, log LeaseLog) {
+	t.Helper()
+	before, err := log.ListLeases(time.Now().Add(-LeaseHistory))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		l.lock.Lock()
+		err := l.claim(LeaseTTL, true)
+		l.lock.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	after, err := log.ListLeases(time.Now().Add(-LeaseHistory))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(before) {
+		t.Errorf("got %d lease messages after renewals, want %d", len(after), len(before))
+	}
+	if !l.Held() {
+		t.Error("lease was lost after renewals")
+	}
+}
+
+func TestLostExclusiveLease(t *testing.T) {
+	fs := newTestDsfs(t, newTestLocalBackend(t, t.TempDir()))
+	fs.exclusive = true
+	if code := fs.Mkdir("/a", 0); code != -fuse.EROFS {
+		t.Errorf("mkdir without the lease returned %d, want %d", code, -fuse.EROFS)
+	}
+	if err := fs.leaser.Acquire(true); err != nil {
+		t.Fatal(err)
+	}
+	defer fs.leaser.Release()
+	if code := fs.Mknod("/a", 0, 0); code != 0 {
+		t.Fatalf("mknod returned %d", code)
+	}
+	if code, _ := fs.Open("/a", fuse.O_RDWR); code != 0 {
+		t.Fatalf("open returned %d", code)
+	}
+	if code := fs.Write("/a", []byte("a"), 0, 0); code != 1 {
+		t.Fatalf("write returned %d", code)
+	}
+
+	// Writes fail once the lease is lost
+	fs.leaser.lock.Lock()
+	fs.leaser.lease = nil
+	fs.leaser.lock.Unlock()
+	for name, code := range map[string]int{
+		"write":   fs.Write("/a", []byte("b"), 0, 0),
+		"release": fs.Release("/a", 0),
+		"rename":  fs.Rename("/a", "/b"),
+		"unlink":  fs.Unlink("/a"),
+	} {
+		if code != -fuse.EROFS {
+			t.Errorf("%s returned %d, want %d", name, code, -fuse.EROFS)
+		}
+	}
+}
+
+func TestReadOnlyMount(t *testing.T) {
+	fs := newTestDsfs(t, newTestLocalBackend(t, t.TempDir()))
+	fs.readOnly.Store(true)
+
+	for name, code := range map[string]int{
+		"mknod":  fs.Mknod("/a", 0, 0),
+		"mkdir":  fs.Mkdir("/a", 0),
+		"rmdir":  fs.Rmdir("/a"),
+		"unlink": fs.Unlink("/a"),
+		"rename": fs.Rename("/a", "/b"),
+	} {
+		if code != -fuse.EROFS {
+			t.Errorf("%s returned %d, want %d", name, code, -fuse.EROFS)
+		}
+	}
+	if code, _ := fs.Open("/", fuse.O_RDWR); code != -fuse.EROFS {
+		t.Errorf("open for writing returned %d, want %d", code, -fuse.EROFS)
+	}
+	if code, _ := fs.Open("/", fuse.O_RDONLY); code != 0 {
+		t.Errorf("open for reading returned %d", code)
+	}
+}
+
+func TestDeleteLeaseID(t *testing.T) {
+	dir := t.TempDir()
+	backend := newTestLocalBackend(t, dir)
+	id, err := backend.AppendLease([]byte("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only lease messages can be deleted
+	for _, invalid := range []string{"../" + TxChannelName, `..\` + TxChannelName, "/" + id} {
+		if err := backend.DeleteLease(invalid); err == nil {
+			t.Errorf("deleted lease %q", invalid)
+		}
+	}
+	if err := backend.DeleteLease(id); err != nil {
+		t.Fatal(err)
+	}
+}
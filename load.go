@@ -81,6 +81,40 @@ func (load *Load) bytesReady(start int64) int64 {
 	return ptr - start
 }
 
+// overlaps determines if any part of range [start, end) is covered
+func (load *Load) overlaps(start, end int64) bool {
+	for _, v := range load.ranges {
+		if v.start < end && v.end > start {
+			return true
+		}
+	}
+	return false
+}
+
+// missing returns the parts of range [start, end) that are not covered
+func (load *Load) missing(start, end int64) []Range {
+	load.sortRanges()
+
+	var gaps []Range
+	ptr := start
+	for _, v := range load.ranges {
+		if v.start >= end {
+			break
+		}
+		if v.start > ptr {
+			gaps = append(gaps, Range{ptr, v.start})
+		}
+		if v.end > ptr {
+			ptr = v.end
+		}
+	}
+	if ptr < end {
+		gaps = append(gaps, Range{ptr, end})
+	}
+
+	return gaps
+}
+
 func newLoad() *Load {
 	return &Load{ranges: make([]Range, 0)}
 }
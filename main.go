@@ -5,10 +5,12 @@ import (
 	"github.com/mattn/go-colorable"
 	"go.uber.org/zap/zapcore"
 	"os"
-	"sync/atomic"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
 
 	"github.com/alecthomas/kingpin/v2"
-	"github.com/bwmarrin/discordgo"
 	"github.com/darenliang/dsfs/fuse"
 	"github.com/valyala/fasthttp"
 	"github.com/valyala/fasthttp/pprofhandler"
@@ -16,19 +18,41 @@ import (
 )
 
 var (
-	token     string
-	userToken bool
-	guildID   string
-	mount     string
-	compact   bool
-	cacheType string
-	dbType    string
-	debug     bool
-	port      int
-	options   []string
-	// We need to jankily expose dsfs for event handlers
-	dsfs      *Dsfs
-	dsfsReady = &atomic.Bool{}
+	token       string
+	userToken   bool
+	guildID     string
+	mount       string
+	compact     bool
+	exclusive   bool
+	snapshot    bool
+	snapshotAt  string
+	at          string
+	maxVersions int
+	restorePath string
+	restoreName string
+	trash       bool
+	trashKeep   time.Duration
+	trashItem   string
+	trashTarget string
+	trashAll    bool
+	cacheType   string
+	compression string
+	downloads   int
+	parity      string
+	dbType      string
+	backendType string
+	localDir    string
+	apiURL      string
+	gatewayURL  string
+	cdnURL      string
+	passphrase  string
+	sealTxs     bool
+	debug       bool
+	port        int
+	options     []string
+	dryRun      bool
+	grace       time.Duration
+	keepVersion bool
 )
 
 func main() {
@@ -36,13 +60,47 @@ func main() {
 	kingpin.Flag("server", "Guild ID").Short('s').StringVar(&guildID)
 	kingpin.Flag("user", "Token is a user token").Short('u').BoolVar(&userToken)
 	kingpin.Flag("mount", "Mount point").Short('m').StringVar(&mount)
-	kingpin.Flag("compact", "Compact transactions").Short('x').BoolVar(&compact)
+	kingpin.Flag("compact", "Compact transactions on startup and while mounted").Short('x').BoolVar(&compact)
+	kingpin.Flag("exclusive", "Hold the volume lease while mounted so that other clients mount read-only").BoolVar(&exclusive)
+	kingpin.Flag("snapshot", "Keep a local snapshot of the DB for fast startup").Default("true").BoolVar(&snapshot)
+	kingpin.Flag("snapshot-file", "Path of the DB snapshot, defaults to the user cache directory").StringVar(&snapshotAt)
+	kingpin.Flag("at", "Mount the volume read-only as it was at a tx message ID or timestamp").StringVar(&at)
+	kingpin.Flag("versions", "Number of previous versions kept per file").Default(strconv.Itoa(MaxVersions)).IntVar(&maxVersions)
+	kingpin.Flag("trash", "Move deleted files and folders to "+TrashDir).BoolVar(&trash)
+	kingpin.Flag("trash-retention", "Time deleted items are kept in the trash").Default(TrashRetention.String()).DurationVar(&trashKeep)
 	kingpin.Flag("cache", "Cache type").Short('c').Default("disk").EnumVar(&cacheType, "disk", "memory")
+	kingpin.Flag("compress", "Compression of data blocks").Short('z').Default("none").EnumVar(&compression, "none", "zstd")
+	kingpin.Flag("downloads", "Number of concurrent block downloads").Default("4").IntVar(&downloads)
+	kingpin.Flag("parity", "Protect new writes with K+M data and parity blocks, e.g. 4+2").StringVar(&parity)
 	kingpin.Flag("db", "Database type").Short('d').Default("radix").EnumVar(&dbType, "radix", "map")
+	kingpin.Flag("backend", "Storage backend type").Short('b').Default("discord").EnumVar(&backendType, "discord", "local")
+	kingpin.Flag("dir", "Directory for the local storage backend").StringVar(&localDir)
+	kingpin.Flag("api", "Base URL of a Discord-compatible REST API").Envar("DSFS_API").StringVar(&apiURL)
+	kingpin.Flag("gateway", "URL of a Discord-compatible gateway").Envar("DSFS_GATEWAY").StringVar(&gatewayURL)
+	kingpin.Flag("cdn", "Base URL of a Discord-compatible CDN").Envar("DSFS_CDN").StringVar(&cdnURL)
+	kingpin.Flag("passphrase", "Passphrase to encrypt data blocks").Envar("DSFS_PASSPHRASE").StringVar(&passphrase)
+	kingpin.Flag("seal-txs", "Encrypt transactions of new volumes").BoolVar(&sealTxs)
 	kingpin.Flag("verbose", "Enable pprof and print debug logs").Short('v').BoolVar(&debug)
 	kingpin.Flag("port", "Port to run pprof on").Short('p').Default("8000").IntVar(&port)
 	kingpin.Flag("options", "FUSE options").Short('o').StringsVar(&options)
-	kingpin.Parse()
+	mountCmd := kingpin.Command("mount", "Mount the volume").Default()
+	checkCmd := kingpin.Command("check", "Read every block and report degraded and lost files")
+	migrateCmd := kingpin.Command("migrate", "Rewrite the tx log into the current format")
+	gcCmd := kingpin.Command("gc", "Delete data messages that are no longer referenced")
+	gcCmd.Flag("dry-run", "Only report reclaimable data messages").BoolVar(&dryRun)
+	gcCmd.Flag("grace", "Minimum age of deleted data messages").Default("24h").DurationVar(&grace)
+	gcCmd.Flag("keep-versions", "Keep blocks of every version still in the tx log").BoolVar(&keepVersion)
+	restoreCmd := kingpin.Command("restore", "Make a previous version the current version of a file")
+	restoreCmd.Arg("path", "Path of the file in the volume").Required().StringVar(&restorePath)
+	restoreCmd.Arg("version", "Name of the version in /.dsfs/versions").Required().StringVar(&restoreName)
+	trashCmd := kingpin.Command("trash", "Manage deleted files and folders")
+	trashListCmd := trashCmd.Command("list", "List the items in the trash").Default()
+	trashRestoreCmd := trashCmd.Command("restore", "Move an item back to where it was deleted from, folders deleted with rm -r are restored empty before their files")
+	trashRestoreCmd.Arg("item", "Name of the item in "+TrashDir).Required().StringVar(&trashItem)
+	trashRestoreCmd.Arg("path", "Path to restore the item to").StringVar(&trashTarget)
+	trashPurgeCmd := trashCmd.Command("purge", "Delete the items older than the retention period for good")
+	trashPurgeCmd.Flag("all", "Delete every item").BoolVar(&trashAll)
+	command := kingpin.Parse()
 
 	if token == "" {
 		token = os.Getenv("DSFS_TOKEN")
@@ -52,7 +110,7 @@ func main() {
 		guildID = os.Getenv("DSFS_SERVER")
 	}
 
-	if token == "" || guildID == "" {
+	if backendType == "discord" && (token == "" || guildID == "") {
 		zap.S().Error("token and guild id are required")
 		return
 	}
@@ -76,44 +134,181 @@ func main() {
 	}
 	defer logger.Sync()
 
-	var tokenPrefix string
-	if !userToken {
-		tokenPrefix = "Bot "
+	if trash && trashKeep <= 0 {
+		zap.S().Error("the trash retention must be positive")
+		return
 	}
-
-	dg, err := discordgo.New(tokenPrefix + token)
-	if err != nil {
-		zap.S().Error("error creating Discord session,", err)
+	if downloads < 1 {
+		zap.S().Error("at least one concurrent download is required")
 		return
 	}
-
-	dg.AddHandler(messageCreate)
-	dg.Identify.Intents = discordgo.IntentsGuildMessages
-
-	err = dg.Open()
+	erasure, err := parseErasure(parity)
 	if err != nil {
-		zap.S().Error("error opening connection,", err)
+		zap.S().Error(err)
 		return
 	}
 
-	txChannel, dataChannel, err := prepareChannels(dg, guildID)
+	var backend Backend
+	switch backendType {
+	case "discord":
+		setEndpoints(apiURL, cdnURL)
+		backend, err = NewDiscordBackend(token, userToken, guildID, gatewayURL)
+	case "local":
+		backend, err = NewLocalBackend(localDir)
+	}
 	if err != nil {
 		zap.S().Error(err)
 		return
 	}
 
-	db, err := setupDB(dg, txChannel, compact, dbType)
+	// Point-in-time mounts replay the tx log up to the point and never
+	// write to the volume
+	pointInTime := at != ""
+	if pointInTime {
+		switch command {
+		case mountCmd.FullCommand(), checkCmd.FullCommand(), trashListCmd.FullCommand():
+		default:
+			zap.S().Error("--at only applies to mount, check and trash list")
+			return
+		}
+		point, err := parseReplayPoint(at)
+		if err != nil {
+			zap.S().Error(err)
+			return
+		}
+		backend = &pointInTimeBackend{Backend: backend, at: point}
+		compact, exclusive, snapshot = false, false, false
+	}
+
+	// Only one client at a time may hold the exclusive mount or rewrite the
+	// tx log
+	leaser := NewLeaser(backend)
+	mounting := command == mountCmd.FullCommand()
+	if mounting && exclusive {
+		if err := leaser.Acquire(true); err != nil {
+			zap.S().Error(err)
+			return
+		}
+		defer leaser.Release()
+	}
+	compactNow := compact
+	if compact {
+		if err := leaser.Acquire(false); err != nil {
+			zap.S().Warnw("skipping compaction on startup", "error", err)
+			compactNow = false
+		}
+	}
+
+	snapshotPath := ""
+	if snapshot {
+		snapshotPath = snapshotAt
+		if snapshotPath == "" {
+			volumeID := backendType + ":" + apiURL + ":" + guildID
+			if backendType == "local" {
+				dir, _ := filepath.Abs(localDir)
+				volumeID = backendType + ":" + dir
+			}
+			snapshotPath, err = defaultSnapshotPath(volumeID)
+			if err != nil {
+				zap.S().Warnw("not keeping a DB snapshot", "error", err)
+			}
+		}
+	}
+
+	volume := NewVolume(passphrase, sealTxs)
+	volume.versions = NewVersionIndex(maxVersions)
+	db, err := loadDB(backend, volume, compactNow, dbType, snapshotPath)
+	if compactNow {
+		leaser.Release()
+	}
 	if err != nil {
 		zap.S().Error(err)
 		return
 	}
+	store := backend
+	backend = volume.Wrap(backend)
 
-	writer := setupWriter(dg, txChannel.ID, dataChannel.ID)
+	if command == gcCmd.FullCommand() {
+		os.Exit(runGC(store, volume, leaser, grace, LeaseRenewInterval+PollInterval, dryRun, keepVersion))
+	}
 
-	dsfs = NewDsfs(dg, db, writer, txChannel, dataChannel, cacheType)
-	dsfsReady.Store(true)
+	if command == checkCmd.FullCommand() {
+		os.Exit(runCheck(NewDsfs(backend, volume, db, nil, nil, cacheType, RawCodec, nil)))
+	}
+
+	if command == migrateCmd.FullCommand() {
+		fs := NewDsfs(backend, volume, db, nil, nil, cacheType, RawCodec, nil)
+		fs.leaser = leaser
+		os.Exit(runMigrate(fs, store))
+	}
+
+	if command == restoreCmd.FullCommand() {
+		fs := NewDsfs(backend, volume, db, nil, nil, cacheType, RawCodec, nil)
+		fs.leaser = leaser
+		os.Exit(runRestore(fs, backend, path.Clean("/"+restorePath), restoreName))
+	}
+
+	switch command {
+	case trashListCmd.FullCommand(), trashRestoreCmd.FullCommand(), trashPurgeCmd.FullCommand():
+		fs := NewDsfs(backend, volume, db, setupWriter(backend), nil, cacheType, RawCodec, nil)
+		fs.leaser = leaser
+		switch command {
+		case trashListCmd.FullCommand():
+			os.Exit(runTrashList(fs))
+		case trashRestoreCmd.FullCommand():
+			if trashTarget != "" {
+				trashTarget = path.Clean("/" + trashTarget)
+			}
+			os.Exit(runTrashRestore(fs, trashItem, trashTarget))
+		default:
+			before := time.Now().Add(-trashKeep)
+			if trashAll {
+				before = time.Now().Add(time.Second)
+			}
+			os.Exit(runTrashPurge(fs, before))
+		}
+	}
+
+	writer := setupWriter(backend)
+
+	dsfs := NewDsfs(backend, volume, db, writer, NewScheduler(downloads), cacheType, GetCodec(compression), erasure)
+	dsfs.leaser = leaser
+	dsfs.exclusive = exclusive
+	switch {
+	case pointInTime:
+		// Live txs are not applied either
+		zap.S().Infow("mounting read-only", "at", at)
+		dsfs.readOnly.Store(true)
+	case !exclusive:
+		if held, err := leaser.HeldByOther(); err == nil {
+			dsfs.readOnly.Store(held)
+		}
+		go dsfs.watchLease(LeaseRenewInterval)
+	}
+	if trash && !pointInTime {
+		dsfs.trash = trashKeep
+		go dsfs.purgeExpiredTrash(TrashPurgeInterval)
+	}
+	if compact {
+		dsfs.compactor = NewCompactor(dsfs, store)
+		go dsfs.compactor.Run(CompactInterval)
+	}
+	if snapshotPath != "" {
+		dsfs.snapshots = NewSnapshotter(dsfs, store, snapshotPath)
+	}
+	if subscriber, ok := store.(TxSubscriber); ok && !pointInTime {
+		subscriber.SubscribeTxs(dsfs)
+	}
 
 	host := fuse.NewFileSystemHost(dsfs)
 	host.SetCapReaddirPlus(true)
 	host.Mount(mount, FuseArgs(options))
+	if dsfs.snapshots != nil {
+		if !dsfs.waitForSends(UnmountSendTimeout) {
+			zap.S().Warn("not every change was appended to the tx log")
+		}
+		if err := dsfs.snapshots.Save(); err != nil {
+			zap.S().Warnw("failed to save DB snapshot", "path", snapshotPath, "error", err)
+		}
+	}
 }
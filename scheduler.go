@@ -0,0 +1,87 @@
+package main
+
+import "sync"
+
+// Priority of a scheduled job
+type Priority int
+
+const (
+	// ReadPriority is used for blocks a caller is waiting on
+	ReadPriority Priority = iota
+	// PrefetchPriority is used for speculative read-ahead
+	PrefetchPriority
+)
+
+// Job is a unit of work run by a Scheduler
+type Job struct {
+	run      func()
+	priority Priority
+	started  bool
+}
+
+// Scheduler runs jobs on a fixed number of workers shared by all open files
+// Queued jobs with ReadPriority always run before PrefetchPriority jobs.
+type Scheduler struct {
+	queues [2][]*Job
+	lock   sync.Mutex
+	cond   *sync.Cond
+}
+
+// NewScheduler creates a new Scheduler and starts its workers
+func NewScheduler(workers int) *Scheduler {
+	s := &Scheduler{}
+	s.cond = sync.NewCond(&s.lock)
+	for i := 0; i < workers; i++ {
+		go s.work()
+	}
+	return s
+}
+
+// Submit queues run with priority
+func (s *Scheduler) Submit(priority Priority, run func()) *Job {
+	job := &Job{run: run, priority: priority}
+	s.lock.Lock()
+	s.queues[priority] = append(s.queues[priority], job)
+	s.lock.Unlock()
+	s.cond.Signal()
+	return job
+}
+
+// Promote raises the priority of a queued job to ReadPriority
+func (s *Scheduler) Promote(job *Job) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if job.started || job.priority == ReadPriority {
+		return
+	}
+	// The stale entry in the prefetch queue is skipped by workers
+	job.priority = ReadPriority
+	s.queues[ReadPriority] = append(s.queues[ReadPriority], job)
+	s.cond.Signal()
+}
+
+// next blocks until a job is available and marks it as started
+func (s *Scheduler) next() *Job {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for {
+		for priority := range s.queues {
+			for len(s.queues[priority]) > 0 {
+				job := s.queues[priority][0]
+				s.queues[priority][0] = nil
+				s.queues[priority] = s.queues[priority][1:]
+				if !job.started && job.priority == Priority(priority) {
+					job.started = true
+					return job
+				}
+			}
+		}
+		s.cond.Wait()
+	}
+}
+
+func (s *Scheduler) work() {
+	for {
+		s.next().run()
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSchedulerPriority(t *testing.T) {
+	s := NewScheduler(1)
+
+	// Occupy the only worker while jobs are queued
+	release := make(chan struct{})
+	s.Submit(ReadPriority, func() { <-release })
+
+	order := make(chan string, 3)
+	s.Submit(PrefetchPriority, func() { order <- "prefetch" })
+	promoted := s.Submit(PrefetchPriority, func() { order <- "promoted" })
+	s.Submit(ReadPriority, func() { order <- "read" })
+	s.Promote(promoted)
+	close(release)
+
+	var got []string
+	for i := 0; i < 3; i++ {
+		got = append(got, <-order)
+	}
+	if want := []string{"read", "promoted", "prefetch"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got order %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// SnapshotVersion is the version of the local DB snapshot format
+const SnapshotVersion = 1
+
+// SnapshotTxs is the number of txs applied while mounted after which the DB
+// snapshot is saved again
+const SnapshotTxs = 1000
+
+// UnmountSendTimeout is how long changes may take to be appended to the tx
+// log before the snapshot is saved on unmount
+const UnmountSendTimeout = time.Minute
+
+// errSnapshotUnusable is returned when the tx log has to be replayed instead
+// of loading a snapshot
+var errSnapshotUnusable = errors.New("snapshot cannot be used")
+
+// snapshotHeader is the plaintext first line of a DB snapshot
+// The root folder tx holds the settings needed to open the rest of the
+// snapshot, which is encrypted like the tx log.
+type snapshotHeader struct {
+	Version int `json:"v"`
+	// Pin is the pinned checkpoint the snapshot was replayed from
+	Pin string `json:"pin"`
+	// Last is the ID of a tx batch up to which every batch is in the
+	// snapshot, and Applied lists the batches after it that are in it too
+	Last    string   `json:"last"`
+	Applied []string `json:"applied,omitempty"`
+	Root    *Tx      `json:"root"`
+}
+
+// snapshotBody holds the tree of a DB snapshot
+type snapshotBody struct {
+	Txs []*Tx `json:"txs"`
+	// Messages maps paths to the tx messages holding their txs
+	Messages map[string]string `json:"msgs,omitempty"`
+	// Versions holds the previous txs of every file, oldest first
+	Versions map[string][]*Tx `json:"versions,omitempty"`
+	LogTxs   int64            `json:"log_txs"`
+	LogBytes int64            `json:"log_bytes"`
+}
+
+// defaultSnapshotPath returns the snapshot file of a volume in the user
+// cache directory
+func defaultSnapshotPath(volumeID string) (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	sum := sha1.Sum([]byte(volumeID))
+	return filepath.Join(dir, "dsfs", hex.EncodeToString(sum[:8])+".snapshot"), nil
+}
+
+// loadDB sets up the DB from the snapshot at path and the tx batches
+// appended since, and saves a new snapshot
+// The whole log is replayed if the snapshot cannot be used, and always when
+// compacting. An empty path only replays the log.
+func loadDB(backend Backend, volume *Volume, compact bool, dbType string, path string) (DB, error) {
+	if path == "" {
+		return setupDB(backend, volume, compact, dbType)
+	}
+
+	var db DB
+	if !compact {
+		var err error
+		db, err = loadSnapshot(backend, volume, dbType, path)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			zap.S().Info("no DB snapshot found, replaying the tx log")
+		case errors.Is(err, errSnapshotUnusable):
+			zap.S().Warnw("replaying the tx log", "error", err)
+		case err != nil:
+			return nil, err
+		}
+	}
+	if db == nil {
+		var err error
+		db, err = setupDB(backend, volume, compact, dbType)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := saveSnapshot(backend, db, volume, path); err != nil {
+		zap.S().Warnw("failed to save DB snapshot", "path", path, "error", err)
+	}
+	return db, nil
+}
+
+// loadSnapshot loads the snapshot at path and applies the tx batches
+// appended after it
+// Errors wrapping errSnapshotUnusable are returned before the DB and the
+// block index are modified.
+func loadSnapshot(backend Backend, volume *Volume, dbType string, path string) (DB, error) {
+	tail, ok := backend.(TxTailer)
+	if !ok {
+		return nil, fmt.Errorf("%w, backend cannot list the end of the tx log", errSnapshotUnusable)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	line, rest, _ := bytes.Cut(data, []byte{'\n'})
+	var header snapshotHeader
+	if err := json.Unmarshal(line, &header); err != nil {
+		return nil, fmt.Errorf("%w, corrupt header, %v", errSnapshotUnusable, err)
+	}
+	if header.Version != SnapshotVersion || header.Root == nil || header.Pin == "" || header.Last == "" {
+		return nil, fmt.Errorf("%w, unsupported version %d", errSnapshotUnusable, header.Version)
+	}
+	pin, err := tail.PinnedCheckpoint()
+	if err != nil {
+		return nil, err
+	}
+	if pin != header.Pin {
+		return nil, fmt.Errorf("%w, pinned checkpoint moved from %s to %s", errSnapshotUnusable, header.Pin, pin)
+	}
+
+	// The tx log unlocks the volume again if the snapshot is unusable
+	if err := volume.Unlock(header.Root); err != nil {
+		return nil, fmt.Errorf("%w, %v", errSnapshotUnusable, err)
+	}
+	opened, err := volume.OpenTxs(rest)
+	if err != nil {
+		return nil, fmt.Errorf("%w, %v", errSnapshotUnusable, err)
+	}
+	var body snapshotBody
+	if err := json.Unmarshal(opened, &body); err != nil {
+		return nil, fmt.Errorf("%w, corrupt tree, %v", errSnapshotUnusable, err)
+	}
+	root := false
+	for _, tx := range body.Txs {
+		if tx == nil || tx.Path == "" || tx.Tx != WriteTx {
+			return nil, fmt.Errorf("%w, corrupt tree", errSnapshotUnusable)
+		}
+		root = root || tx.Path == "/"
+	}
+	if !root {
+		return nil, fmt.Errorf("%w, root folder is missing", errSnapshotUnusable)
+	}
+
+	db := GetNewDB(dbType)
+	for _, tx := range body.Txs {
+		db.Insert(tx.Path, tx)
+		if id, ok := body.Messages[tx.Path]; ok {
+			db.SetMessage(tx.Path, id)
+		}
+		volume.blocks.Add(tx)
+	}
+	for _, versions := range body.Versions {
+		for _, tx := range versions {
+			if tx != nil {
+				volume.versions.Add(tx)
+			}
+		}
+	}
+	volume.logTxs.Store(body.LogTxs)
+	volume.logBytes.Store(body.LogBytes)
+	volume.lastTx = header.Last
+	zap.S().Infow("loaded DB snapshot", "path", path, "txs", len(body.Txs), "last", header.Last)
+
+	records, err := tail.ListTxsAfter(header.Last)
+	if err != nil {
+		return nil, err
+	}
+	skip := make(map[string]bool)
+	for _, id := range header.Applied {
+		skip[id] = true
+	}
+	var missing []TxRecord
+	for _, record := range records {
+		if !skip[record.ID] {
+			missing = append(missing, record)
+		}
+	}
+	if err := applyMessageTxs(db, volume, missing, nil, nil); err != nil {
+		return nil, err
+	}
+	if len(records) != 0 {
+		volume.lastTx = records[len(records)-1].ID
+	}
+	return db, nil
+}
+
+// saveSnapshot writes the DB and the ID of the last applied tx batch to path
+func saveSnapshot(backend Backend, db DB, volume *Volume, path string) error {
+	data, err := encodeSnapshot(backend, db, volume)
+	if err != nil {
+		return err
+	}
+	return writeSnapshot(path, data)
+}
+
+// encodeSnapshot encodes the DB and the ID of the last applied tx batch
+func encodeSnapshot(backend Backend, db DB, volume *Volume) ([]byte, error) {
+	tail, ok := backend.(TxTailer)
+	if !ok {
+		return nil, errors.New("backend cannot list the end of the tx log")
+	}
+	pin, err := tail.PinnedCheckpoint()
+	if err != nil {
+		return nil, err
+	}
+	if pin == "" || volume.lastTx == "" {
+		return nil, errors.New("tx log has no pinned checkpoint")
+	}
+
+	body := snapshotBody{
+		Messages: make(map[string]string),
+		Versions: volume.versions.All(),
+		LogTxs:   volume.logTxs.Load(),
+		LogBytes: volume.logBytes.Load(),
+	}
+	it := db.Iterator("/")
+	for key, tx, ok := it.Next(); ok; key, tx, ok = it.Next() {
+		body.Txs = append(body.Txs, tx)
+		if id, ok := db.Message(key); ok {
+			body.Messages[key] = id
+		}
+	}
+	b, err := json.Marshal(&body)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := volume.SealTxs(b)
+	if err != nil {
+		return nil, err
+	}
+	var applied []string
+	for id := range volume.appliedTxs {
+		applied = append(applied, id)
+	}
+	sort.Slice(applied, func(i, j int) bool { return txIDLess(applied[i], applied[j]) })
+	header, err := json.Marshal(snapshotHeader{
+		Version: SnapshotVersion,
+		Pin:     pin,
+		Last:    volume.lastTx,
+		Applied: applied,
+		Root:    volume.root,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append(append(header, '\n'), sealed...), nil
+}
+
+// writeSnapshot writes an encoded snapshot to path
+func writeSnapshot(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	// Write to a temporary file first so a crash never leaves a partial
+	// snapshot
+	if err := os.WriteFile(path+".tmp", data, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	zap.S().Debugw("saved DB snapshot", "path", path)
+	return nil
+}
+
+// Snapshotter saves the DB snapshot of a mounted volume every SnapshotTxs
+// applied txs and when the volume is unmounted
+type Snapshotter struct {
+	fs      *Dsfs
+	backend Backend
+	path    string
+	// pending is the number of txs applied since the last save
+	pending int
+	saving  bool
+	lock    sync.Mutex
+	// saveLock serializes writes of the snapshot file
+	saveLock sync.Mutex
+}
+
+// NewSnapshotter creates a new Snapshotter that saves to path and reads the
+// pin from the unwrapped backend
+func NewSnapshotter(fs *Dsfs, backend Backend, path string) *Snapshotter {
+	return &Snapshotter{fs: fs, backend: backend, path: path}
+}
+
+// Record counts txs applied to the tree and saves the snapshot in the
+// background once there are SnapshotTxs of them
+func (s *Snapshotter) Record(txs int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.pending += txs
+	if s.pending < SnapshotTxs || s.saving {
+		return
+	}
+	s.saving = true
+	go func() {
+		if err := s.Save(); err != nil {
+			zap.S().Warnw("failed to save DB snapshot", "path", s.path, "error", err)
+		}
+		s.lock.Lock()
+		s.saving = false
+		s.lock.Unlock()
+	}()
+}
+
+// Save saves the snapshot of the tree and the applied tx batches
+// Trees with changes that are not in the tx log yet are not saved.
+func (s *Snapshotter) Save() error {
+	s.saveLock.Lock()
+	defer s.saveLock.Unlock()
+	s.lock.Lock()
+	s.pending = 0
+	s.lock.Unlock()
+
+	tail, ok := s.backend.(TxTailer)
+	if !ok {
+		return errors.New("backend cannot list the end of the tx log")
+	}
+	fs := s.fs
+	fs.lock.Lock()
+	last := fs.volume.lastTx
+	fs.lock.Unlock()
+	ids, err := tail.ListTxIDsAfter(last)
+	if err != nil {
+		return err
+	}
+
+	fs.lock.Lock()
+	if fs.unsent.Load() != 0 {
+		fs.lock.Unlock()
+		return errors.New("tree has changes that were not appended to the tx log")
+	}
+	fs.volume.advance(ids)
+	data, err := encodeSnapshot(s.backend, fs.db, fs.volume)
+	fs.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeSnapshot(s.path, data)
+}
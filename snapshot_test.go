@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// listingBackend counts full replays of the tx log
+type listingBackend struct {
+	*LocalBackend
+	listed int
+}
+
+func (b *listingBackend) ListTxs() ([]TxRecord, error) {
+	b.listed++
+	return b.LocalBackend.ListTxs()
+}
+
+func TestDBSnapshot(t *testing.T) {
+	backend := &listingBackend{LocalBackend: newTestLocalBackend(t, t.TempDir())}
+	path := filepath.Join(t.TempDir(), "volume.snapshot")
+	appendTxs := func(txs ...Tx) {
+		t.Helper()
+		for _, tx := range txs {
+			if _, err := backend.AppendTxs([][]byte{encodeTx(tx)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	load := func(compact bool, replayed bool, want map[string]bool) {
+		t.Helper()
+		backend.listed = 0
+		volume := NewVolume("", false)
+		db, err := loadDB(backend, volume, compact, "map", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (backend.listed != 0) != replayed {
+			t.Errorf("replayed the tx log %d times", backend.listed)
+		}
+		for p, exists := range want {
+			if _, ok := db.Get(p); ok != exists {
+				t.Errorf("path %s exists = %v, want %v", p, ok, exists)
+			}
+		}
+		if _, ok := db.Message("/b"); want["/b"] && !ok {
+			t.Error("message of /b was not restored")
+		}
+	}
+
+	load(false, true, map[string]bool{"/": true})
+	appendTxs(
+		Tx{Tx: WriteTx, Path: "/a", Type: FolderType},
+		Tx{Tx: WriteTx, Path: "/b", Type: FolderType},
+	)
+	load(false, false, map[string]bool{"/a": true, "/b": true})
+
+	// Only batches after the snapshot are applied
+	appendTxs(createDeleteTx("/a"), Tx{Tx: WriteTx, Path: "/c", Type: FolderType})
+	load(false, false, map[string]bool{"/a": false, "/b": true, "/c": true})
+
+	// Moving the pin invalidates the snapshot
+	load(true, true, map[string]bool{"/a": false, "/b": true, "/c": true})
+	appendTxs(Tx{Tx: WriteTx, Path: "/d", Type: FolderType})
+	load(false, false, map[string]bool{"/b": true, "/c": true, "/d": true})
+
+	// Corrupt snapshots fall back to replaying the log
+	backend = &listingBackend{LocalBackend: newTestLocalBackend(t, t.TempDir())}
+	load(false, true, map[string]bool{"/": true})
+	appendTxs(Tx{Tx: WriteTx, Path: "/e", Type: FolderType})
+	if err := os.WriteFile(path, []byte("{\"v\":1}\ngarbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	load(false, true, map[string]bool{"/e": true})
+	load(false, false, map[string]bool{"/e": true})
+}
+
+func TestDBSnapshotSealed(t *testing.T) {
+	backend := newTestLocalBackend(t, t.TempDir())
+	path := filepath.Join(t.TempDir(), "volume.snapshot")
+	if _, err := loadDB(backend, NewVolume("passphrase", true), false, "map", path); err != nil {
+		t.Fatal(err)
+	}
+	volume := NewVolume("passphrase", false)
+	if _, err := loadDB(backend, volume, false, "map", path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := volume.Wrap(backend).AppendTxs([][]byte{encodeTx(Tx{Tx: WriteTx, Path: "/secret", Type: FolderType})}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadDB(backend, NewVolume("passphrase", false), false, "map", path); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("/secret")) {
+		t.Error("snapshot of an encrypted volume contains plaintext paths")
+	}
+	db, err := loadDB(backend, NewVolume("passphrase", false), false, "map", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := db.Get("/secret"); !ok {
+		t.Error("path is missing from the snapshot")
+	}
+}
+
+func TestDBSnapshotVersions(t *testing.T) {
+	backend := &listingBackend{LocalBackend: newTestLocalBackend(t, t.TempDir())}
+	path := filepath.Join(t.TempDir(), "volume.snapshot")
+	if _, err := loadDB(backend, NewVolume("", false), false, "map", path); err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int64{1, 2, 3} {
+		if _, err := backend.AppendTxs([][]byte{encodeTx(Tx{Tx: WriteTx, Path: "/f", Type: FileType, Size: size})}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Versions are applied from the tail of the log first, then restored from
+	// the snapshot
+	for i := 0; i < 2; i++ {
+		backend.listed = 0
+		volume := NewVolume("", false)
+		if _, err := loadDB(backend, volume, false, "map", path); err != nil {
+			t.Fatal(err)
+		}
+		if backend.listed != 0 {
+			t.Errorf("replayed the tx log %d times", backend.listed)
+		}
+		versions := volume.versions.Get("/f")
+		if len(versions) != 2 || versions[0].Size != 1 || versions[1].Size != 2 {
+			t.Errorf("expected versions of size 1 and 2, got %v", versions)
+		}
+	}
+}
+
+func TestMountedSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	backend := newTestLocalBackend(t, dir)
+	path := filepath.Join(t.TempDir(), "volume.snapshot")
+	volume := NewVolume("", false)
+	db, err := loadDB(backend, volume, false, "map", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := NewDsfs(backend, volume, db, setupWriter(backend), NewScheduler(4), "memory", RawCodec, nil)
+	fs.leaser = NewLeaser(backend)
+	fs.snapshots = NewSnapshotter(fs, backend, path)
+	saved, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The snapshot is saved in the background once enough txs were applied
+	sent := fs.volume.logTxs.Load()
+	if errc := fs.Mkdir("/a", 0); errc != 0 {
+		t.Fatalf("Mkdir, %d", errc)
+	}
+	waitForTxs(t, fs, sent, 1)
+	fs.snapshots.Record(SnapshotTxs)
+	waitFor(t, "snapshot to be saved", func() bool {
+		fs.snapshots.lock.Lock()
+		defer fs.snapshots.lock.Unlock()
+		return !fs.snapshots.saving
+	})
+	if data, err := os.ReadFile(path); err != nil || bytes.Equal(data, saved) {
+		t.Fatalf("snapshot was not saved, %v", err)
+	}
+
+	// And when the volume is unmounted
+	sent = fs.volume.logTxs.Load()
+	if errc := fs.Mkdir("/b", 0); errc != 0 {
+		t.Fatalf("Mkdir, %d", errc)
+	}
+	writeFile(t, fs, "/b/f", []byte("f"))
+	waitForTxs(t, fs, sent, 2)
+	if err := fs.snapshots.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Batches in the snapshot are not replayed, so the mounted changes are
+	// loaded even without them
+	records, err := backend.ListTxs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range records[1:] {
+		if err := os.Remove(filepath.Join(dir, TxChannelName, record.ID)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db, err = loadDB(backend, NewVolume("", false), false, "map", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"/a", "/b"} {
+		if _, ok := db.Get(p); !ok {
+			t.Errorf("%s is missing from the snapshot", p)
+		}
+	}
+	if tx, ok := db.Get("/b/f"); !ok || tx.Size != 1 {
+		t.Errorf("got %v for the uploaded file, want a file of size 1", tx)
+	}
+}
+
+// failingBackend fails every tx batch that is appended
+type failingBackend struct {
+	Backend
+	appends atomic.Int64
+}
+
+func (b *failingBackend) AppendTxs(batches [][]byte) ([]string, error) {
+	b.appends.Add(1)
+	return nil, errors.New("append failed")
+}
+
+// readSnapshotHeader reads the header of the snapshot at path
+func readSnapshotHeader(t *testing.T, path string) snapshotHeader {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, _, _ := bytes.Cut(data, []byte{'\n'})
+	var header snapshotHeader
+	if err := json.Unmarshal(line, &header); err != nil {
+		t.Fatal(err)
+	}
+	return header
+}
+
+func TestSnapshotWatermark(t *testing.T) {
+	backend := newTestLocalBackend(t, t.TempDir())
+	path := filepath.Join(t.TempDir(), "volume.snapshot")
+	volume := NewVolume("", false)
+	db, err := loadDB(backend, volume, false, "map", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := NewDsfs(backend, volume, db, setupWriter(backend), NewScheduler(4), "memory", RawCodec, nil)
+	fs.snapshots = NewSnapshotter(fs, backend, path)
+
+	// A remote batch that was not received yet precedes a batch of this client
+	remote := encodeTx(Tx{Tx: WriteTx, Path: "/remote", Type: FolderType})
+	ids, err := backend.AppendTxs([][]byte{remote})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := fs.volume.logTxs.Load()
+	if errc := fs.Mkdir("/b", 0); errc != 0 {
+		t.Fatalf("Mkdir, %d", errc)
+	}
+	waitForTxs(t, fs, sent, 1)
+	if err := fs.snapshots.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if header := readSnapshotHeader(t, path); header.Last >= ids[0] || len(header.Applied) != 1 {
+		t.Fatalf("snapshot is complete up to %s with %v, want before %s", header.Last, header.Applied, ids[0])
+	}
+	volume = NewVolume("", false)
+	db, err = loadDB(backend, volume, false, "map", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"/remote", "/b"} {
+		if _, ok := db.Get(p); !ok {
+			t.Errorf("%s is missing after loading the snapshot", p)
+		}
+	}
+	// Batches in the snapshot are not applied again
+	if got, want := volume.logTxs.Load(), fs.volume.logTxs.Load()+1; got != want {
+		t.Errorf("got %d txs in the log, want %d", got, want)
+	}
+
+	// Once the remote batch arrives every batch is in the snapshot
+	if err := applyMessageTxs(fs.db, fs.volume, []TxRecord{{ID: ids[0], Data: remote}}, nil, fs); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.snapshots.Save(); err != nil {
+		t.Fatal(err)
+	}
+	records, err := backend.ListTxs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header := readSnapshotHeader(t, path); header.Last != records[len(records)-1].ID || len(header.Applied) != 0 {
+		t.Errorf("snapshot is complete up to %s with %v, want %s", header.Last, header.Applied, records[len(records)-1].ID)
+	}
+}
+
+func TestSnapshotUnsent(t *testing.T) {
+	backend := newTestLocalBackend(t, t.TempDir())
+	path := filepath.Join(t.TempDir(), "volume.snapshot")
+	volume := NewVolume("", false)
+	db, err := loadDB(backend, volume, false, "map", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := NewDsfs(backend, volume, db, setupWriter(&failingBackend{Backend: backend}), NewScheduler(4), "memory", RawCodec, nil)
+	fs.snapshots = NewSnapshotter(fs, backend, path)
+
+	// Changes that never reached the tx log are not saved
+	if errc := fs.Mkdir("/unsent", 0); errc != 0 {
+		t.Fatalf("Mkdir, %d", errc)
+	}
+	if fs.waitForSends(5 * time.Second) {
+		t.Fatal("failed send was not reported")
+	}
+	if err := fs.snapshots.Save(); err == nil {
+		t.Fatal("saved a snapshot with unsent changes")
+	}
+	db, err = loadDB(backend, NewVolume("", false), false, "map", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := db.Get("/unsent"); ok {
+		t.Error("unsent change was loaded")
+	}
+}
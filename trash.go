@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/darenliang/dsfs/fuse"
+	"go.uber.org/zap"
+)
+
+// Trash settings
+const (
+	// TrashDir holds the files and folders deleted while the trash is enabled
+	TrashDir = "/.trash"
+	// TrashRetention is the default time trashed items are kept for
+	TrashRetention = 30 * 24 * time.Hour
+	// TrashPurgeInterval is how often expired items are purged while mounted
+	TrashPurgeInterval = 10 * time.Minute
+)
+
+// TrashInfo records where an item in the trash was deleted from
+type TrashInfo struct {
+	Path string    `json:"path"`
+	Time time.Time `json:"time"`
+}
+
+// inTrash reports whether path is the trash folder or in it
+func inTrash(path string) bool {
+	return path == TrashDir || strings.HasPrefix(path, TrashDir+"/")
+}
+
+// trashes reports whether deleting path moves it to the trash
+// Items already in the trash are deleted for good.
+func (fs *Dsfs) trashes(path string) bool {
+	return fs.trash > 0 && !inTrash(path)
+}
+
+// trashPath names the trash item of path deleted at a time
+// Items are named after the deletion time and the name of path so that they
+// sort by deletion time. fs.lock must be held.
+func (fs *Dsfs) trashPath(path string, at time.Time) string {
+	name := at.UTC().Format("2006-01-02T15-04-05.000Z") + "_" + filepath.Base(path)
+	item := TrashDir + "/" + name
+	for i := 2; ; i++ {
+		if _, ok := fs.db.Get(item); !ok {
+			return item
+		}
+		item = fmt.Sprintf("%s/%s~%d", TrashDir, name, i)
+	}
+}
+
+// moveToTrash moves a file or an empty folder to the trash in one tx batch
+// Folders deleted recursively end up as one item per path since their
+// contents are unlinked first.
+func (fs *Dsfs) moveToTrash(path string) int {
+	fs.lock.Lock()
+	tx, ok := fs.db.Get(path)
+	if !ok {
+		fs.lock.Unlock()
+		return -fuse.ENOENT
+	}
+
+	var lines [][]byte
+	var sent []*Tx
+	var folder *Tx
+	if _, ok := fs.db.Get(TrashDir); !ok {
+		folder = &Tx{Tx: WriteTx, Path: TrashDir, Type: FolderType}
+		lines = append(lines, encodeTx(*folder))
+		sent = append(sent, folder)
+	}
+	now := time.Now()
+	trashed := *tx
+	trashed.Tx = WriteTx
+	trashed.Path = fs.trashPath(path, now)
+	trashed.Trashed = &TrashInfo{Path: path, Time: now}
+	lines = append(lines, encodeTx(trashed), encodeTx(createDeleteTx(path)))
+	sent = append(sent, &trashed)
+	b := bytes.Join(lines, []byte{'\n'})
+	if len(b) > MaxDiscordFileSize-fs.volume.TxOverhead() {
+		fs.lock.Unlock()
+		return -fuse.EACCES
+	}
+
+	if folder != nil {
+		fs.db.Insert(TrashDir, folder)
+	}
+	fs.db.Insert(trashed.Path, &trashed)
+	fs.db.Delete(path)
+	delete(fs.open, path)
+	fs.unsent.Add(1)
+	fs.lock.Unlock()
+	// The same as replaying the batch
+	fs.volume.supersede(nil, &trashed)
+	fs.volume.supersede(tx, nil)
+
+	go func() { fs.sendTx(b, sent...) }()
+	zap.S().Debugw("moved to trash", "path", path, "item", trashed.Path)
+	return 0
+}
+
+// trashItems returns the items in the trash sorted by deletion time
+// Items moved into the trash by hand have no deletion time and are listed
+// first. fs.lock must be held.
+func (fs *Dsfs) trashItems() []*Tx {
+	var items []*Tx
+	it := fs.db.Iterator(TrashDir + "/")
+	for key, tx, ok := it.Next(); ok; key, tx, ok = it.Next() {
+		if getDir(key) == TrashDir {
+			items = append(items, tx)
+		}
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		return trashTime(items[i]).Before(trashTime(items[j]))
+	})
+	return items
+}
+
+// trashTime returns the deletion time of a trash item
+func trashTime(tx *Tx) time.Time {
+	if tx.Trashed == nil {
+		return time.Time{}
+	}
+	return tx.Trashed.Time
+}
+
+// purgeTrash deletes the trash items deleted before a time with everything
+// in them, and returns the tx batches recording it
+func (fs *Dsfs) purgeTrash(before time.Time) [][]byte {
+	maxSize := MaxDiscordFileSize - fs.volume.TxOverhead()
+	var batches [][]byte
+	var batch []byte
+	fs.lock.Lock()
+	for _, item := range fs.trashItems() {
+		if item.Trashed == nil || !item.Trashed.Time.Before(before) {
+			continue
+		}
+		var purged []*Tx
+		it := fs.db.Iterator(item.Path)
+		for key, tx, ok := it.Next(); ok; key, tx, ok = it.Next() {
+			if key == item.Path || strings.HasPrefix(key, item.Path+"/") {
+				purged = append(purged, tx)
+			}
+		}
+		for _, tx := range purged {
+			fs.db.Delete(tx.Path)
+			delete(fs.open, tx.Path)
+			fs.volume.supersede(tx, nil)
+			line := encodeTx(createDeleteTx(tx.Path))
+			if len(batch) != 0 && len(batch)+len(line)+1 > maxSize {
+				batches = append(batches, batch)
+				batch = nil
+			}
+			batch = append(append(batch, line...), '\n')
+		}
+		zap.S().Infow("purged trash item", "item", item.Path, "path", item.Trashed.Path)
+	}
+	if len(batch) != 0 {
+		batches = append(batches, batch)
+	}
+	fs.unsent.Add(int64(len(batches)))
+	fs.lock.Unlock()
+	return batches
+}
+
+// purgeExpiredTrash purges the trash items older than fs.trash until the
+// volume is unmounted
+func (fs *Dsfs) purgeExpiredTrash(interval time.Duration) {
+	for {
+		if !fs.readOnly.Load() {
+			for _, b := range fs.purgeTrash(time.Now().Add(-fs.trash)) {
+				fs.sendTx(b)
+			}
+		}
+		time.Sleep(interval)
+	}
+}
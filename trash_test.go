@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// waitForTxs waits until fs has sent n more txs since sent was loaded
+func waitForTxs(t *testing.T, fs *Dsfs, sent int64, n int64) {
+	t.Helper()
+	waitFor(t, "txs to be sent", func() bool { return fs.volume.logTxs.Load() >= sent+n })
+}
+
+// findTrashItem returns the trash item of path
+func findTrashItem(t *testing.T, fs *Dsfs, path string) *Tx {
+	t.Helper()
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	for _, item := range fs.trashItems() {
+		if item.Trashed != nil && item.Trashed.Path == path {
+			return item
+		}
+	}
+	t.Fatalf("%s is not in the trash", path)
+	return nil
+}
+
+func TestTrash(t *testing.T) {
+	dir := t.TempDir()
+	fs := newTestDsfs(t, newTestLocalBackend(t, dir))
+	fs.trash = time.Hour
+
+	data := []byte("trashed data")
+	if errc := fs.Mkdir("/dir", 0); errc != 0 {
+		t.Fatalf("Mkdir, %d", errc)
+	}
+	writeFile(t, fs, "/dir/a", data)
+	sent := fs.volume.logTxs.Load()
+	if errc := fs.Unlink("/dir/a"); errc != 0 {
+		t.Fatalf("Unlink, %d", errc)
+	}
+	if errc := fs.Rmdir("/dir"); errc != 0 {
+		t.Fatalf("Rmdir, %d", errc)
+	}
+	// The trash folder, the items and the deletes of the original paths
+	waitForTxs(t, fs, sent, 5)
+
+	// Trash items are replayed with their original path
+	fs = newTestDsfs(t, newTestLocalBackend(t, dir))
+	fs.trash = time.Hour
+	fs.lock.Lock()
+	_, ok := fs.db.Get("/dir")
+	fs.lock.Unlock()
+	if ok {
+		t.Fatal("/dir was not deleted")
+	}
+	file := findTrashItem(t, fs, "/dir/a")
+	folder := findTrashItem(t, fs, "/dir")
+	if getDir(file.Path) != TrashDir || file.Type != FileType || folder.Type != FolderType {
+		t.Fatalf("unexpected trash items %s and %s", file.Path, folder.Path)
+	}
+	if file.Trashed.Time.After(folder.Trashed.Time) {
+		t.Error("items were deleted out of order")
+	}
+
+	// Moving items out of the trash restores them
+	sent = fs.volume.logTxs.Load()
+	if errc := fs.Rename(folder.Path, "/dir"); errc != 0 {
+		t.Fatalf("Rename folder, %d", errc)
+	}
+	waitForTxs(t, fs, sent, 2)
+	if code := runTrashRestore(fs, filepath.Base(file.Path), ""); code != 0 {
+		t.Fatalf("trash restore exited with %d", code)
+	}
+	fs = newTestDsfs(t, newTestLocalBackend(t, dir))
+	fs.lock.Lock()
+	restored, ok := fs.db.Get("/dir/a")
+	items := len(fs.trashItems())
+	fs.lock.Unlock()
+	if !ok || restored.Trashed != nil || items != 0 {
+		t.Fatalf("restored %v, %d items left in the trash", restored, items)
+	}
+	if got := readFile(t, fs, "/dir/a", len(data)); !bytes.Equal(got, data) {
+		t.Errorf("restored file reads %q, want %q", got, data)
+	}
+}
+
+func TestTrashPurge(t *testing.T) {
+	dir := t.TempDir()
+	fs := newTestDsfs(t, newTestLocalBackend(t, dir))
+	fs.trash = time.Hour
+
+	writeFile(t, fs, "/a", []byte("a"))
+	writeFile(t, fs, "/b", []byte("b"))
+	sent := fs.volume.logTxs.Load()
+	fs.Unlink("/a")
+	waitForTxs(t, fs, sent, 3)
+	deleted := time.Now()
+	sent = fs.volume.logTxs.Load()
+	fs.Unlink("/b")
+	waitForTxs(t, fs, sent, 2)
+
+	// Items in the trash are deleted for good
+	item := findTrashItem(t, fs, "/b")
+	if errc := fs.Unlink(item.Path); errc != 0 {
+		t.Fatalf("Unlink trash item, %d", errc)
+	}
+	fs.lock.Lock()
+	items := fs.trashItems()
+	fs.lock.Unlock()
+	if len(items) != 1 || items[0].Trashed.Path != "/a" {
+		t.Fatalf("expected only /a in the trash, got %d items", len(items))
+	}
+
+	if batches := fs.purgeTrash(deleted.Add(-time.Minute)); len(batches) != 0 {
+		t.Errorf("purged %d batches of unexpired items", len(batches))
+	}
+	if code := runTrashPurge(fs, deleted); code != 0 {
+		t.Fatalf("trash purge exited with %d", code)
+	}
+	fs = newTestDsfs(t, newTestLocalBackend(t, dir))
+	fs.lock.Lock()
+	items = fs.trashItems()
+	fs.lock.Unlock()
+	if len(items) != 0 {
+		t.Errorf("expected an empty trash, got %d items", len(items))
+	}
+}
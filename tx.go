@@ -3,122 +3,226 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
 	"fmt"
 	"time"
 
-	"github.com/bwmarrin/discordgo"
-	"github.com/valyala/fasthttp"
 	"go.uber.org/zap"
 )
 
+// TxFormatVersion is the version of the tx format written by this version of
+// dsfs
+// Txs written before versions were recorded have version 0 and are read as
+// version 1. Volumes and txs with newer versions are refused.
+const TxFormatVersion = 1
+
 type Tx struct {
-	Ctim      time.Time `json:"ctim,omitempty"`
-	Mtim      time.Time `json:"mtim,omitempty"`
-	Path      string    `json:"path"`
-	FileIDs   []string  `json:"ids,omitempty"`
-	Checksums []string  `json:"sums,omitempty"`
-	Tx        TxType    `json:"tx"`
-	Type      InodeType `json:"type,omitempty"`
-	Size      int64     `json:"size,omitempty"`
+	Ctim      time.Time  `json:"ctim,omitempty"`
+	Mtim      time.Time  `json:"mtim,omitempty"`
+	Path      string     `json:"path"`
+	FileIDs   []string   `json:"ids,omitempty"`
+	Checksums []string   `json:"sums,omitempty"`
+	Tx        TxType     `json:"tx"`
+	Type      InodeType  `json:"type,omitempty"`
+	Size      int64      `json:"size,omitempty"`
+	Key       *KeyParams `json:"key,omitempty"`
+	// Codecs is parallel to FileIDs and omitted if no block is encoded
+	Codecs []Codec `json:"codecs,omitempty"`
+	// Lengths is parallel to FileIDs and omitted by txs with fixed
+	// FileBlockSize blocks
+	Lengths []int64 `json:"lens,omitempty"`
+	// Erasure is set if every stripe of K blocks is protected by M parity
+	// blocks stored in Parity
+	Erasure *ErasureParams `json:"ec,omitempty"`
+	Parity  []string       `json:"parity,omitempty"`
+	// MessageIDs and ParityMessageIDs are parallel to FileIDs and Parity
+	// and store the messages holding the blocks on backends that have them
+	MessageIDs       []string `json:"msgs,omitempty"`
+	ParityMessageIDs []string `json:"parity_msgs,omitempty"`
+	// Version is the format version of the tx, and of the volume if the tx
+	// is the root folder tx
+	Version int `json:"v,omitempty"`
+	// Trashed is set on items in the trash folder
+	Trashed *TrashInfo `json:"trashed,omitempty"`
 }
 
-// getDataFile downloads an attachment and writes to buffer
-func getDataFile(channelID string, fileID string, buffer []byte) (int, error) {
-	req := fasthttp.AcquireRequest()
-	req.SetRequestURI(fmt.Sprintf("https://cdn.discordapp.com/attachments/%s/%s/%s", channelID, fileID, DataChannelName))
-	req.Header.SetMethod(fasthttp.MethodGet)
-	resp := fasthttp.AcquireResponse()
-	err := fasthttp.Do(req, resp)
-	fasthttp.ReleaseRequest(req)
-	if err != nil {
-		return 0, err
+// blockChecksum computes the checksum of a decoded block
+func blockChecksum(data []byte) string {
+	sum := sha1.Sum(data)
+	return base64.URLEncoding.EncodeToString(sum[:])
+}
+
+// Offsets returns the offset of every block followed by the end of the last
+// block
+func (tx *Tx) Offsets() []int64 {
+	offsets := make([]int64, len(tx.FileIDs)+1)
+	for i := range tx.FileIDs {
+		length := int64(FileBlockSize)
+		if i < len(tx.Lengths) {
+			length = tx.Lengths[i]
+		} else if i == len(tx.FileIDs)-1 && tx.Size > offsets[i] && tx.Size-offsets[i] < length {
+			length = tx.Size - offsets[i]
+		}
+		offsets[i+1] = offsets[i] + length
 	}
-	n := copy(buffer, resp.Body())
-	fasthttp.ReleaseResponse(resp)
-	return n, nil
+	return offsets
 }
 
-// createDeleteTx creates a delete transaction for path
-func createDeleteTx(path string) Tx {
-	return Tx{Tx: DeleteTx, Path: path}
+// Codec returns the codec of block idx
+func (tx *Tx) Codec(idx int) Codec {
+	if idx < len(tx.Codecs) {
+		return tx.Codecs[idx]
+	}
+	return RawCodec
 }
 
-// applyMessageTxs applies transactions to DB, and writes message data to buffer if a buffer is given
-func applyMessageTxs(db DB, ms []*discordgo.Message, buffer *bytes.Buffer, live bool) {
-	zap.S().Infof("applying %d messages with TXs", len(ms))
-	for _, m := range ms {
-		for _, file := range m.Attachments {
-			_, data, err := fasthttp.Get(nil, file.URL)
-			if err != nil {
-				zap.S().Warnf("%s, skipping tx batch", err)
-				continue
-			}
+// BlockRef returns the reference of block idx
+func (tx *Tx) BlockRef(idx int) BlobRef {
+	ref := BlobRef{ID: tx.FileIDs[idx]}
+	if idx < len(tx.MessageIDs) {
+		ref.MessageID = tx.MessageIDs[idx]
+	}
+	return ref
+}
 
-			bytesReader := bytes.NewReader(data)
-			scanner := bufio.NewScanner(bytesReader)
-
-			for scanner.Scan() {
-				line := scanner.Text()
-				if len(line) == 0 {
-					continue
-				}
-				tx := &Tx{}
-				err := json.Unmarshal([]byte(line), tx)
-				if err != nil {
-					zap.S().Warnf("%s, skipping tx", err)
-					continue
-				}
-
-				switch tx.Tx {
-				case WriteTx:
-					zap.S().Debugw("Write", "path", tx.Path)
-					if live {
-						err := dsfs.ApplyLiveTx(tx.Path, tx)
-						if err != nil {
-							zap.S().Warnw("failed to apply live tx", "error", err)
-						}
-					} else {
-						db.Insert(tx.Path, tx)
-					}
-				case DeleteTx:
-					zap.S().Debugw("Delete", "path", tx.Path)
-					if live {
-						dsfs.lock.Lock()
-						db.Delete(tx.Path)
-						delete(dsfs.open, tx.Path)
-						dsfs.lock.Unlock()
-					} else {
-						db.Delete(tx.Path)
-					}
-				default:
-					zap.S().Warnf("found unknown tx type %d, skipping tx", tx.Tx)
-					continue
-				}
-
-				// Write to buffer
-				if buffer != nil {
-					buffer.WriteString(line)
-					buffer.WriteByte('\n')
-				}
-			}
+// ParityRef returns the reference of parity block idx
+func (tx *Tx) ParityRef(idx int) BlobRef {
+	ref := BlobRef{ID: tx.Parity[idx]}
+	if idx < len(tx.ParityMessageIDs) {
+		ref.MessageID = tx.ParityMessageIDs[idx]
+	}
+	return ref
+}
+
+// located reports whether the message of every block is known
+func (tx *Tx) located() bool {
+	return len(tx.MessageIDs) == len(tx.FileIDs) && len(tx.ParityMessageIDs) == len(tx.Parity)
+}
+
+// hasMessageIDs reports whether any message ID is set
+func hasMessageIDs(ids []string) bool {
+	for _, id := range ids {
+		if id != "" {
+			return true
 		}
 	}
-	zap.S().Info("done applying TXs")
+	return false
 }
 
-func messageCreate(s *discordgo.Session, m *discordgo.MessageCreate) {
-	// Not ready to accept TXs
-	if !dsfsReady.Load() {
-		return
+// encoded reports whether any block is encoded
+func (tx *Tx) encoded() bool {
+	for _, codec := range tx.Codecs {
+		if codec != RawCodec {
+			return true
+		}
 	}
+	return false
+}
+
+// encodeTx marshals tx in the current format
+func encodeTx(tx Tx) []byte {
+	tx.Version = TxFormatVersion
+	b, _ := json.Marshal(&tx)
+	return b
+}
 
-	// Don't handle the bot's own TXs or listen to a non-TX channel
-	if m.Author.ID == s.State.User.ID || m.ChannelID != dsfs.txChannel.ID {
-		return
+// decodeTx parses a tx and rejects txs this version of dsfs cannot apply
+func decodeTx(line []byte) (*Tx, error) {
+	tx := &Tx{}
+	if err := json.Unmarshal(line, tx); err != nil {
+		return nil, fmt.Errorf("invalid tx, %w", err)
+	}
+	if tx.Version > TxFormatVersion {
+		return nil, fmt.Errorf("tx of %s has format %d but only format %d is supported, upgrade dsfs",
+			tx.Path, tx.Version, TxFormatVersion)
+	}
+	if tx.Tx != WriteTx && tx.Tx != DeleteTx {
+		return nil, fmt.Errorf("tx of %s has unknown type %d", tx.Path, tx.Tx)
 	}
+	return tx, nil
+}
+
+// createDeleteTx creates a delete transaction for path
+func createDeleteTx(path string) Tx {
+	return Tx{Tx: DeleteTx, Path: path}
+}
+
+// readTxs decodes the txs of a tx batch and returns them with the plaintext
+// batch
+// Lines can be as long as a whole batch, so a tx that cannot be read fails
+// the batch instead of ending it early.
+func readTxs(volume *Volume, record TxRecord) ([]*Tx, []byte, error) {
+	data, err := volume.OpenTxs(record.Data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("tx batch %s, %w", record.ID, err)
+	}
+	var txs []*Tx
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, MaxDiscordFileSize)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		tx, err := decodeTx(line)
+		if err != nil {
+			return nil, nil, fmt.Errorf("tx batch %s, %w", record.ID, err)
+		}
+		txs = append(txs, tx)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, fmt.Errorf("tx batch %s, %w", record.ID, err)
+	}
+	return txs, data, nil
+}
+
+// applyMessageTxs applies transactions to DB, and writes message data to buffer if a buffer is given
+// Tx batches that cannot be decrypted or decoded abort the replay. Batches of
+// remote clients are applied to the mounted live volume, which is nil while
+// replaying.
+func applyMessageTxs(db DB, volume *Volume, records []TxRecord, buffer *bytes.Buffer, live *Dsfs) error {
+	zap.S().Infof("applying %d tx batches", len(records))
+	for _, record := range records {
+		// Txs that cannot be applied abort the replay instead of leaving a
+		// partially loaded tree
+		batch, data, err := readTxs(volume, record)
+		if err != nil {
+			return err
+		}
 
-	// There is potentially some issues when doing this
-	// In this current state, open files will not be affected
-	// by any TXs broadcasted by remote clients
-	applyMessageTxs(dsfs.db, []*discordgo.Message{m.Message}, nil, true)
+		if live != nil {
+			// Live batches are applied as a whole
+			if err := live.ApplyLiveTxs(batch, record.ID); err != nil {
+				zap.S().Warnw("failed to apply live tx", "error", err)
+			}
+			live.logTx(record.ID, data)
+			continue
+		}
+		for _, tx := range batch {
+			switch tx.Tx {
+			case WriteTx:
+				zap.S().Debugw("Write", "path", tx.Path)
+				old, _ := db.Get(tx.Path)
+				db.Insert(tx.Path, tx)
+				db.SetMessage(tx.Path, record.ID)
+				volume.supersede(old, tx)
+			case DeleteTx:
+				zap.S().Debugw("Delete", "path", tx.Path)
+				old, _ := db.Get(tx.Path)
+				db.Delete(tx.Path)
+				volume.supersede(old, nil)
+			}
+		}
+		if buffer != nil {
+			for _, line := range txLines(data) {
+				buffer.Write(line)
+				buffer.WriteByte('\n')
+			}
+		}
+		volume.countTxs(data)
+		volume.lastTx = record.ID
+	}
+	zap.S().Infow("done applying TXs", "blocks", volume.blocks.Len())
+	return nil
 }
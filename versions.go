@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/darenliang/dsfs/fuse"
+)
+
+// Virtual directories served by every mount
+const (
+	// DsfsDir holds the virtual directories and is not listed in the root
+	DsfsDir = "/.dsfs"
+	// VersionsDir mirrors the tree with the previous versions of every file
+	VersionsDir = DsfsDir + "/versions"
+	// MaxVersions is the default number of previous versions kept per path
+	MaxVersions = 10
+)
+
+// VersionIndex keeps the previous txs of every file
+// Versions are kept for the txs replayed or applied since the DB was set up,
+// so versions before the pinned checkpoint are lost on compaction.
+type VersionIndex struct {
+	versions map[string][]*Tx
+	max      int
+	lock     sync.Mutex
+}
+
+// NewVersionIndex creates a new VersionIndex keeping max versions per path
+func NewVersionIndex(max int) *VersionIndex {
+	return &VersionIndex{versions: make(map[string][]*Tx), max: max}
+}
+
+// Add records a superseded or deleted file tx as a version of its path
+func (i *VersionIndex) Add(tx *Tx) {
+	if tx == nil || tx.Type != FileType || i.max <= 0 {
+		return
+	}
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	versions := append(i.versions[tx.Path], tx)
+	if len(versions) > i.max {
+		versions = versions[len(versions)-i.max:]
+	}
+	i.versions[tx.Path] = versions
+}
+
+// Get returns the versions of path, oldest first
+func (i *VersionIndex) Get(path string) []*Tx {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	return append([]*Tx(nil), i.versions[path]...)
+}
+
+// All returns the versions of every path
+func (i *VersionIndex) All() map[string][]*Tx {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	all := make(map[string][]*Tx, len(i.versions))
+	for path, versions := range i.versions {
+		all[path] = append([]*Tx(nil), versions...)
+	}
+	return all
+}
+
+// Paths returns every path with versions below dir
+func (i *VersionIndex) Paths(dir string) []string {
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	var paths []string
+	for path := range i.versions {
+		if strings.HasPrefix(path, prefix) {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// versionNames names versions by their modification time
+// Versions with the same time are told apart by their position.
+func versionNames(versions []*Tx) []string {
+	names := make([]string, len(versions))
+	seen := make(map[string]bool)
+	for i, tx := range versions {
+		name := "unknown"
+		if !tx.Mtim.IsZero() {
+			name = tx.Mtim.UTC().Format("2006-01-02T15-04-05.000Z")
+		}
+		if seen[name] {
+			name = fmt.Sprintf("%s~%d", name, i)
+		}
+		seen[name] = true
+		names[i] = name
+	}
+	return names
+}
+
+// findVersion looks up the version of path with name
+func findVersion(index *VersionIndex, path string, name string) (*Tx, bool) {
+	versions := index.Get(path)
+	for i, n := range versionNames(versions) {
+		if n == name {
+			return versions[i], true
+		}
+	}
+	return nil, false
+}
+
+// isVirtual reports whether path is served by the virtual directories
+func isVirtual(path string) bool {
+	return path == DsfsDir || strings.HasPrefix(path, DsfsDir+"/")
+}
+
+// readOnlyPath reports whether paths cannot be modified
+func (fs *Dsfs) readOnlyPath(paths ...string) bool {
+	if fs.readOnly.Load() || fs.exclusive && !fs.leaser.Held() {
+		return true
+	}
+	for _, path := range paths {
+		if isVirtual(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// versionPath returns the path of the tree a path below VersionsDir mirrors
+func versionPath(path string) (string, bool) {
+	if path == VersionsDir {
+		return "/", true
+	}
+	if !strings.HasPrefix(path, VersionsDir+"/") {
+		return "", false
+	}
+	return strings.TrimPrefix(path, VersionsDir), true
+}
+
+// lookupVirtual resolves a virtual path to a folder, or to a file version
+func (fs *Dsfs) lookupVirtual(path string) (tx *Tx, dir bool, ok bool) {
+	if path == DsfsDir {
+		return nil, true, true
+	}
+	mirrored, ok := versionPath(path)
+	if !ok {
+		return nil, false, false
+	}
+	if mirrored != "/" {
+		if tx, ok := findVersion(fs.volume.versions, getDir(mirrored), filepath.Base(mirrored)); ok {
+			return tx, false, true
+		}
+	}
+	if mirrored == "/" || len(fs.volume.versions.Get(mirrored)) > 0 || len(fs.volume.versions.Paths(mirrored)) > 0 {
+		return nil, true, true
+	}
+	return nil, false, false
+}
+
+// getattrVirtual fills the stat of a virtual path
+func (fs *Dsfs) getattrVirtual(path string, stat *fuse.Stat_t) int {
+	tx, dir, ok := fs.lookupVirtual(path)
+	if !ok {
+		return -fuse.ENOENT
+	}
+	if dir {
+		stat.Mode = fuse.S_IFDIR | 0o555
+		return 0
+	}
+	stat.Mode = fuse.S_IFREG | 0o444
+	stat.Size = tx.Size
+	stat.Ctim = fuse.NewTimespec(tx.Ctim)
+	stat.Mtim = fuse.NewTimespec(tx.Mtim)
+	return 0
+}
+
+// readdirVirtual lists a virtual folder
+// Folders below VersionsDir list the versions of the mirrored file and the
+// children with versions of the mirrored folder.
+func (fs *Dsfs) readdirVirtual(path string, fill func(name string, stat *fuse.Stat_t, ofst int64) bool) int {
+	_, dir, ok := fs.lookupVirtual(path)
+	if !ok {
+		return -fuse.ENOENT
+	}
+	if !dir {
+		return -fuse.ENOTDIR
+	}
+	fill(".", &fuse.Stat_t{Mode: fuse.S_IFDIR | 0o555}, 0)
+	fill("..", nil, 0)
+	if path == DsfsDir {
+		fill(filepath.Base(VersionsDir), &fuse.Stat_t{Mode: fuse.S_IFDIR | 0o555}, 0)
+		return 0
+	}
+
+	mirrored, _ := versionPath(path)
+	versions := fs.volume.versions.Get(mirrored)
+	for i, name := range versionNames(versions) {
+		fill(name, &fuse.Stat_t{
+			Mode: fuse.S_IFREG | 0o444,
+			Size: versions[i].Size,
+			Ctim: fuse.NewTimespec(versions[i].Ctim),
+			Mtim: fuse.NewTimespec(versions[i].Mtim),
+		}, 0)
+	}
+	children := make(map[string]bool)
+	prefix := strings.TrimSuffix(mirrored, "/") + "/"
+	for _, p := range fs.volume.versions.Paths(mirrored) {
+		child, _, _ := strings.Cut(strings.TrimPrefix(p, prefix), "/")
+		children[child] = true
+	}
+	names := make([]string, 0, len(children))
+	for name := range children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fill(name, &fuse.Stat_t{Mode: fuse.S_IFDIR | 0o555}, 0)
+	}
+	return 0
+}
+
+// openVersion opens a file version for reading
+// fs.lock must be held.
+func (fs *Dsfs) openVersion(path string) int {
+	tx, dir, ok := fs.lookupVirtual(path)
+	if !ok {
+		return -fuse.ENOENT
+	}
+	if dir {
+		return 0
+	}
+	cache := fs.GetNewCache()
+	cache.Truncate(tx.Size)
+	fs.open[path] = &FileData{
+		cache:   cache,
+		load:    newLoad(),
+		syncing: &atomic.Bool{},
+		mtim:    tx.Mtim,
+		ctim:    tx.Ctim,
+		tx:      tx,
+		offsets: tx.Offsets(),
+		fetches: make(map[int]*blockFetch),
+	}
+	return 0
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/darenliang/dsfs/fuse"
+)
+
+// overwriteFile replaces the data of path and waits until it is released
+func overwriteFile(t *testing.T, fs *Dsfs, path string, data []byte) {
+	t.Helper()
+	fs.lock.Lock()
+	old, _ := fs.db.Get(path)
+	fs.lock.Unlock()
+	if errc, _ := fs.Open(path, fuse.O_RDWR); errc != 0 {
+		t.Fatalf("Open %s, %d", path, errc)
+	}
+	if errc := fs.Truncate(path, 0, 0); errc != 0 {
+		t.Fatalf("Truncate %s, %d", path, errc)
+	}
+	if n := fs.Write(path, data, 0, 0); n != len(data) {
+		t.Fatalf("Write %s, %d", path, n)
+	}
+	fs.Release(path, 0)
+	waitFor(t, "release of "+path, func() bool {
+		fs.lock.Lock()
+		defer fs.lock.Unlock()
+		tx, _ := fs.db.Get(path)
+		return tx != old && !fs.open[path].syncing.Load()
+	})
+}
+
+// readdir lists the names in path
+func readdir(t *testing.T, fs *Dsfs, path string) []string {
+	t.Helper()
+	var names []string
+	errc := fs.Readdir(path, func(name string, stat *fuse.Stat_t, ofst int64) bool {
+		if name != "." && name != ".." {
+			names = append(names, name)
+		}
+		return true
+	}, 0, 0)
+	if errc != 0 {
+		t.Fatalf("Readdir %s, %d", path, errc)
+	}
+	return names
+}
+
+func TestVersionIndex(t *testing.T) {
+	index := NewVersionIndex(2)
+	at := time.Date(2024, 1, 2, 3, 4, 5, 6e6, time.UTC)
+	index.Add(&Tx{Path: "/a", Type: FileType, Size: 1, Mtim: at})
+	index.Add(&Tx{Path: "/a", Type: FileType, Size: 2, Mtim: at})
+	index.Add(&Tx{Path: "/a", Type: FileType, Size: 3, Mtim: at.Add(time.Second)})
+	index.Add(&Tx{Path: "/dir", Type: FolderType})
+	index.Add(nil)
+
+	versions := index.Get("/a")
+	if len(versions) != 2 || versions[0].Size != 2 || versions[1].Size != 3 {
+		t.Fatalf("expected the last 2 versions, got %v", versions)
+	}
+	if len(index.Get("/dir")) != 0 {
+		t.Error("folders have no versions")
+	}
+	names := versionNames(append(versions, &Tx{Mtim: at.Add(time.Second)}, &Tx{}))
+	want := []string{"2024-01-02T03-04-05.006Z", "2024-01-02T03-04-06.006Z", "2024-01-02T03-04-06.006Z~2", "unknown"}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Errorf("name %d is %q, want %q", i, names[i], want[i])
+		}
+	}
+}
+
+func TestVersions(t *testing.T) {
+	dir := t.TempDir()
+	fs := newTestDsfs(t, newTestLocalBackend(t, dir))
+
+	v1 := []byte("first version")
+	v2 := []byte("second")
+	if errc := fs.Mkdir("/dir", 0); errc != 0 {
+		t.Fatalf("Mkdir, %d", errc)
+	}
+	writeFile(t, fs, "/dir/a", v1)
+	overwriteFile(t, fs, "/dir/a", v2)
+
+	check := func(fs *Dsfs) string {
+		t.Helper()
+		if names := readdir(t, fs, "/"); len(names) != 1 || names[0] != "dir" {
+			t.Errorf("root lists %v, want [dir]", names)
+		}
+		if names := readdir(t, fs, VersionsDir); len(names) != 1 || names[0] != "dir" {
+			t.Errorf("versions list %v, want [dir]", names)
+		}
+		names := readdir(t, fs, VersionsDir+"/dir/a")
+		if len(names) != 1 {
+			t.Fatalf("expected 1 version, got %v", names)
+		}
+		path := VersionsDir + "/dir/a/" + names[0]
+		var stat fuse.Stat_t
+		if errc := fs.Getattr(path, &stat, 0); errc != 0 || stat.Mode != fuse.S_IFREG|0o444 || stat.Size != int64(len(v1)) {
+			t.Errorf("Getattr %s, %d, mode %o, size %d", path, errc, stat.Mode, stat.Size)
+		}
+		if got := readFile(t, fs, path, len(v1)); !bytes.Equal(got, v1) {
+			t.Errorf("version reads %q, want %q", got, v1)
+		}
+		return names[0]
+	}
+	check(fs)
+
+	// Versions are rebuilt when the tx log is replayed
+	fs = newTestDsfs(t, newTestLocalBackend(t, dir))
+	name := check(fs)
+
+	path := VersionsDir + "/dir/a/" + name
+	for op, code := range map[string]int{
+		"mknod":  fs.Mknod(VersionsDir+"/b", 0, 0),
+		"mkdir":  fs.Mkdir(DsfsDir, 0),
+		"unlink": fs.Unlink(path),
+		"rename": fs.Rename("/dir/a", path),
+		"write":  fs.Write(path, []byte("x"), 0, 0),
+	} {
+		if code != -fuse.EROFS {
+			t.Errorf("%s returned %d, want %d", op, code, -fuse.EROFS)
+		}
+	}
+	if errc, _ := fs.Open(path, fuse.O_RDWR); errc != -fuse.EROFS {
+		t.Errorf("open for writing returned %d, want %d", errc, -fuse.EROFS)
+	}
+	var stat fuse.Stat_t
+	if errc := fs.Getattr(VersionsDir+"/dir/missing", &stat, 0); errc != -fuse.ENOENT {
+		t.Errorf("Getattr of a path without versions returned %d", errc)
+	}
+
+	// Restoring publishes the old tx, which becomes a version itself
+	if code := runRestore(fs, fs.volume.Wrap(fs.backend), "/dir/a", name); code != 0 {
+		t.Fatalf("restore exited with %d", code)
+	}
+	if code := runRestore(fs, fs.volume.Wrap(fs.backend), "/dir/a", "missing"); code == 0 {
+		t.Error("restoring a missing version succeeded")
+	}
+	fs = newTestDsfs(t, newTestLocalBackend(t, dir))
+	if got := readFile(t, fs, "/dir/a", len(v1)); !bytes.Equal(got, v1) {
+		t.Errorf("restored file reads %q, want %q", got, v1)
+	}
+	if names := readdir(t, fs, VersionsDir+"/dir/a"); len(names) != 2 {
+		t.Errorf("expected 2 versions after restore, got %v", names)
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// SealedTxMagic prefixes encrypted tx batches
+// Plaintext batches are JSON lines, so they can never start with it.
+var SealedTxMagic = []byte("DSFS\x00SEALED\x00")
+
+// Volume holds the settings shared by every client of a volume
+// The settings are stored in the root folder tx, which stays in plaintext so
+// that clients can derive the key before reading the rest of the tx log.
+type Volume struct {
+	passphrase string
+	sealTxs    bool
+	sealer     *Sealer
+	root       *Tx
+	// blocks indexes every data block stored in the volume
+	blocks *BlockIndex
+	// versions keeps the previous txs of every file
+	versions *VersionIndex
+	// logTxs and logBytes measure the tx log since its start point
+	logTxs   atomic.Int64
+	logBytes atomic.Int64
+	// lastTx is the ID of a tx batch up to which every batch of the log was
+	// applied to the DB, and appliedTxs holds the batches applied after it
+	// fs.lock must be held once the volume is mounted.
+	lastTx     string
+	appliedTxs map[string]bool
+}
+
+// NewVolume creates a new Volume
+// sealTxs only applies when a new volume is created.
+func NewVolume(passphrase string, sealTxs bool) *Volume {
+	return &Volume{
+		passphrase: passphrase,
+		sealTxs:    sealTxs,
+		blocks:     NewBlockIndex(),
+		versions:   NewVersionIndex(MaxVersions),
+	}
+}
+
+// supersede updates the indexes of the volume once old was replaced by tx,
+// or deleted if tx is nil
+func (v *Volume) supersede(old *Tx, tx *Tx) {
+	v.blocks.Replace(old, tx)
+	if old != tx {
+		v.versions.Add(old)
+	}
+}
+
+// countTxs adds the txs of a plaintext tx batch to the log size
+func (v *Volume) countTxs(data []byte) {
+	for _, line := range bytes.Split(data, []byte{'\n'}) {
+		if len(line) != 0 {
+			v.logTxs.Add(1)
+			v.logBytes.Add(int64(len(line)) + 1)
+		}
+	}
+}
+
+// applied records that the tx batch id was applied to the DB
+// Batches of remote clients may arrive out of order, so lastTx only moves
+// once every batch before them is known to be applied.
+func (v *Volume) applied(id string) {
+	if v.lastTx != "" && !txIDLess(v.lastTx, id) {
+		return
+	}
+	if v.appliedTxs == nil {
+		v.appliedTxs = make(map[string]bool)
+	}
+	v.appliedTxs[id] = true
+}
+
+// advance moves lastTx over the applied batches at the start of ids, the
+// batches of the log after lastTx
+func (v *Volume) advance(ids []string) {
+	for _, id := range ids {
+		if !v.appliedTxs[id] {
+			return
+		}
+		v.lastTx = id
+		delete(v.appliedTxs, id)
+	}
+}
+
+// NewRoot creates the root folder tx of a new volume
+func (v *Volume) NewRoot() (*Tx, error) {
+	tx := &Tx{
+		Tx:      WriteTx,
+		Path:    "/",
+		Type:    FolderType,
+		Version: TxFormatVersion,
+	}
+	if v.sealTxs && v.passphrase == "" {
+		return nil, errors.New("encrypting transactions requires a passphrase")
+	}
+	if v.passphrase != "" {
+		var err error
+		tx.Key, err = newKeyParams(v.passphrase)
+		if err != nil {
+			return nil, err
+		}
+		tx.Key.Txs = v.sealTxs
+	}
+	return tx, nil
+}
+
+// Unlock derives the volume key from the settings stored in root
+func (v *Volume) Unlock(root *Tx) error {
+	if root.Version > TxFormatVersion {
+		return fmt.Errorf("volume has format %d but only format %d is supported, upgrade dsfs",
+			root.Version, TxFormatVersion)
+	}
+	v.root = root
+	if root.Key == nil {
+		if v.passphrase != "" {
+			return errors.New("passphrase given but volume is not encrypted")
+		}
+		return nil
+	}
+	if v.passphrase == "" {
+		return errors.New("volume is encrypted, a passphrase is required")
+	}
+	if v.sealTxs && !root.Key.Txs {
+		return errors.New("volume transactions are not encrypted")
+	}
+
+	key, err := root.Key.Key(v.passphrase)
+	if err != nil {
+		return err
+	}
+	v.sealer, err = NewSealer(key)
+	return err
+}
+
+// Version returns the tx format version of the volume
+func (v *Volume) Version() int {
+	return v.root.Version
+}
+
+// Unlocked returns if data blocks are encrypted
+func (v *Volume) Unlocked() bool {
+	return v.sealer != nil
+}
+
+// SealsTxs returns if tx batches are encrypted
+func (v *Volume) SealsTxs() bool {
+	return v.sealer != nil && v.root.Key.Txs
+}
+
+// TxOverhead is the number of bytes added to encrypted tx batches
+func (v *Volume) TxOverhead() int {
+	if !v.SealsTxs() {
+		return 0
+	}
+	return len(SealedTxMagic) + v.sealer.Overhead()
+}
+
+// Header returns the plaintext batch that starts every tx log of the volume
+func (v *Volume) Header() []byte {
+	b, _ := json.Marshal(v.root)
+	return b
+}
+
+// SealTxs encrypts a tx batch if the volume encrypts transactions
+func (v *Volume) SealTxs(data []byte) ([]byte, error) {
+	if !v.SealsTxs() {
+		return data, nil
+	}
+	sealed, err := v.sealer.Seal(data)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte{}, SealedTxMagic...), sealed...), nil
+}
+
+// OpenTxs decrypts a tx batch
+// Batches that do not match the encryption mode of the volume are rejected,
+// except for plaintext volume headers.
+func (v *Volume) OpenTxs(data []byte) ([]byte, error) {
+	if bytes.HasPrefix(data, SealedTxMagic) {
+		if !v.SealsTxs() {
+			return nil, errors.New("found encrypted tx batch but volume transactions are not encrypted")
+		}
+		opened, err := v.sealer.Open(data[len(SealedTxMagic):])
+		if err != nil {
+			return nil, errors.New("failed to decrypt tx batch, the tx log may have been tampered with")
+		}
+		return opened, nil
+	}
+	if v.SealsTxs() && !isHeader(data) {
+		return nil, errors.New("found plaintext tx batch but volume transactions are encrypted")
+	}
+	return data, nil
+}
+
+// isHeader determines if a batch only contains root folder txs with key parameters
+func isHeader(data []byte) bool {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		tx := &Tx{}
+		if json.Unmarshal(scanner.Bytes(), tx) != nil || tx.Path != "/" || tx.Key == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// readRoot parses the root folder tx from the first line of a tx log
+func readRoot(records []TxRecord) (*Tx, error) {
+	if bytes.HasPrefix(records[0].Data, SealedTxMagic) {
+		return nil, errors.New("tx log starts with an encrypted batch, volume header is missing")
+	}
+	line := records[0].Data
+	if i := bytes.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	tx := &Tx{}
+	err := json.Unmarshal(line, tx)
+	if err != nil {
+		return nil, err
+	}
+	if tx.Path != "/" {
+		return nil, errors.New("tx log does not start with the root folder")
+	}
+	return tx, nil
+}
+
+// Wrap wraps backend to encrypt data blocks and tx batches
+func (v *Volume) Wrap(backend Backend) Backend {
+	if !v.Unlocked() {
+		return backend
+	}
+	return &SealedBackend{Backend: backend, volume: v}
+}
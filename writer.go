@@ -1,11 +1,6 @@
 package main
 
-import (
-	"bytes"
-	"time"
-
-	"github.com/bwmarrin/discordgo"
-)
+import "time"
 
 type QueueItem struct {
 	channel chan QueueResult
@@ -13,8 +8,8 @@ type QueueItem struct {
 }
 
 type QueueResult struct {
-	err    error
-	fileID string
+	err error
+	ref BlobRef
 }
 
 type Writer struct {
@@ -23,24 +18,27 @@ type Writer struct {
 }
 
 func (w *Writer) SendTx(data []byte) (string, error) {
-	return w.sendToQueue(data, w.txQueue)
+	ref, err := w.sendToQueue(data, w.txQueue)
+	return ref.ID, err
 }
 
-func (w *Writer) SendData(data []byte) (string, error) {
+// SendData stores a data block and returns where it was stored
+func (w *Writer) SendData(data []byte) (BlobRef, error) {
 	return w.sendToQueue(data, w.dataQueue)
 }
 
-func (w *Writer) sendToQueue(data []byte, queue chan<- QueueItem) (string, error) {
+func (w *Writer) sendToQueue(data []byte, queue chan<- QueueItem) (BlobRef, error) {
 	callback := make(chan QueueResult)
 	queue <- QueueItem{
 		data:    data,
 		channel: callback,
 	}
 	result := <-callback
-	return result.fileID, result.err
+	return result.ref, result.err
 }
 
-func (w *Writer) processQueue(dg *discordgo.Session, filename string, channelID string, queue <-chan QueueItem) {
+// processQueue batches queued items and stores each batch with send
+func (w *Writer) processQueue(send func([][]byte) ([]BlobRef, error), queue <-chan QueueItem) {
 	go func() {
 		var onhold []QueueItem
 		for {
@@ -66,14 +64,11 @@ func (w *Writer) processQueue(dg *discordgo.Session, filename string, channelID
 				continue
 			}
 
-			var files []*discordgo.File
-			for _, item := range items {
-				files = append(files, &discordgo.File{
-					Name:   filename,
-					Reader: bytes.NewReader(item.data),
-				})
+			data := make([][]byte, len(items))
+			for i, item := range items {
+				data[i] = item.data
 			}
-			msg, err := dg.ChannelMessageSendComplex(channelID, &discordgo.MessageSend{Files: files})
+			refs, err := send(data)
 			for i := 0; i < len(items); i++ {
 				if err != nil {
 					items[i].channel <- QueueResult{
@@ -81,7 +76,7 @@ func (w *Writer) processQueue(dg *discordgo.Session, filename string, channelID
 					}
 				} else {
 					items[i].channel <- QueueResult{
-						fileID: msg.Attachments[i].ID,
+						ref: refs[i],
 					}
 				}
 			}
@@ -89,20 +84,30 @@ func (w *Writer) processQueue(dg *discordgo.Session, filename string, channelID
 	}()
 }
 
-func (w *Writer) ProcessTxQueue(dg *discordgo.Session, channelID string) {
-	w.processQueue(dg, TxChannelName, channelID, w.txQueue)
+func (w *Writer) ProcessTxQueue(backend Backend) {
+	w.processQueue(func(batches [][]byte) ([]BlobRef, error) {
+		ids, err := backend.AppendTxs(batches)
+		if err != nil {
+			return nil, err
+		}
+		refs := make([]BlobRef, len(ids))
+		for i, id := range ids {
+			refs[i] = BlobRef{ID: id}
+		}
+		return refs, nil
+	}, w.txQueue)
 }
 
-func (w *Writer) ProcessDataQueue(dg *discordgo.Session, channelID string) {
-	w.processQueue(dg, DataChannelName, channelID, w.dataQueue)
+func (w *Writer) ProcessDataQueue(backend Backend) {
+	w.processQueue(backend.PutBlobs, w.dataQueue)
 }
 
-func setupWriter(dg *discordgo.Session, txChannelID, dataChannelID string) *Writer {
+func setupWriter(backend Backend) *Writer {
 	writer := &Writer{
 		txQueue:   make(chan QueueItem),
 		dataQueue: make(chan QueueItem),
 	}
-	writer.ProcessDataQueue(dg, dataChannelID)
-	writer.ProcessTxQueue(dg, txChannelID)
+	writer.ProcessDataQueue(backend)
+	writer.ProcessTxQueue(backend)
 	return writer
 }